@@ -0,0 +1,169 @@
+// Package breaker provides circuit breakers failing fast the requests to
+// sick memcached servers, instead of piling them up until they time out.
+package breaker
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/netflix/rend/metrics"
+)
+
+// ErrOpen is returned for requests to a server whose circuit is open.
+var ErrOpen = errors.New("breaker: circuit open")
+
+type state int
+
+const (
+	closed state = iota
+	open
+	halfOpen
+)
+
+func (s state) String() string {
+	switch s {
+	case closed:
+		return "closed"
+	case open:
+		return "open"
+	}
+	return "half-open"
+}
+
+// Breakers holds a circuit breaker for each server. A circuit opens when
+// too many of the requests of a window fail or are too slow, and rejects
+// all requests for a while. It then lets a single trial request through,
+// closing again if it succeeds.
+type Breakers struct {
+	maxErrorRate float64
+	maxLatency   time.Duration
+	minRequests  int
+	window       time.Duration
+	openTime     time.Duration
+
+	metricTrips      uint32
+	metricRejections uint32
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state state
+	// since is the start of the current window while closed, the time the
+	// circuit opened otherwise.
+	since    time.Time
+	requests int
+	bad      int
+	trial    bool
+}
+
+// New returns circuit breakers opening for openTime when at least
+// minRequests requests were made during window, and the maxErrorRate
+// fraction of them failed or took longer than maxLatency. A zero
+// maxLatency leaves latency out. tags tell apart the metrics of each set
+// of breakers.
+func New(maxErrorRate float64, maxLatency time.Duration, minRequests int, window, openTime time.Duration, tags metrics.Tags) *Breakers {
+	return &Breakers{
+		maxErrorRate:     maxErrorRate,
+		maxLatency:       maxLatency,
+		minRequests:      minRequests,
+		window:           window,
+		openTime:         openTime,
+		metricTrips:      metrics.AddCounter("breaker_trips", tags),
+		metricRejections: metrics.AddCounter("breaker_rejections", tags),
+		circuits:         map[string]*circuit{},
+	}
+}
+
+func (b *Breakers) circuit(addr net.Addr) *circuit {
+	c, ok := b.circuits[addr.String()]
+	if !ok {
+		c = &circuit{since: time.Now()}
+		b.circuits[addr.String()] = c
+	}
+	return c
+}
+
+// Allow returns ErrOpen when requests to the server at addr must fail
+// fast. It is meant to be the Allow hook of a memcache.Client.
+func (b *Breakers) Allow(addr net.Addr) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.circuit(addr)
+	switch c.state {
+	case open:
+		if time.Since(c.since) < b.openTime {
+			break
+		}
+		c.state = halfOpen
+		fallthrough
+	case halfOpen:
+		if c.trial {
+			break
+		}
+		c.trial = true
+		return nil
+	default:
+		return nil
+	}
+
+	metrics.IncCounter(b.metricRejections)
+	return ErrOpen
+}
+
+// Observe records the outcome of a request to the server at addr. It is
+// meant to be the Observer of a memcache.Client.
+func (b *Breakers) Observe(addr net.Addr, elapsed time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.circuit(addr)
+	bad := err != nil || (b.maxLatency > 0 && elapsed > b.maxLatency)
+	switch c.state {
+	case halfOpen:
+		c.trial = false
+		if bad {
+			b.trip(addr, c)
+			return
+		}
+		c.state = closed
+		c.since = time.Now()
+		c.requests, c.bad = 0, 0
+		log.WithField("server", addr.String()).Info("Circuit closed")
+
+	case closed:
+		if time.Since(c.since) > b.window {
+			c.since = time.Now()
+			c.requests, c.bad = 0, 0
+		}
+		c.requests++
+		if bad {
+			c.bad++
+		}
+		if c.requests >= b.minRequests && float64(c.bad) >= b.maxErrorRate*float64(c.requests) {
+			b.trip(addr, c)
+		}
+	}
+}
+
+// trip opens c. b.mu must be held.
+func (b *Breakers) trip(addr net.Addr, c *circuit) {
+	log.WithFields(log.Fields{
+		"server":    addr.String(),
+		"from":      c.state,
+		"requests":  c.requests,
+		"bad":       c.bad,
+		"open-time": b.openTime,
+	}).Warn("Circuit opened")
+	metrics.IncCounter(b.metricTrips)
+
+	c.state = open
+	c.since = time.Now()
+	c.requests, c.bad = 0, 0
+}
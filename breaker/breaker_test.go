@@ -0,0 +1,113 @@
+package breaker
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var errFailed = errors.New("failed")
+
+var addr, _ = net.ResolveTCPAddr("tcp", "127.0.0.1:11211")
+
+// request is the outcome of a request observed by breakers.
+type request struct {
+	elapsed time.Duration
+	err     error
+}
+
+var (
+	ok   = request{elapsed: time.Millisecond}
+	fail = request{elapsed: time.Millisecond, err: errFailed}
+	slow = request{elapsed: 50 * time.Millisecond}
+)
+
+func newBreakers(maxLatency time.Duration, openTime time.Duration) *Breakers {
+	return New(0.5, maxLatency, 4, time.Minute, openTime, metrics.Tags{"test": "breaker"})
+}
+
+func TestCircuitOpens(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		maxLatency time.Duration
+		requests   []request
+		open       bool
+	}{
+		{name: "error rate reached", requests: []request{ok, fail, ok, fail}, open: true},
+		{name: "error rate not reached", requests: []request{ok, fail, ok, ok}, open: false},
+		{name: "too few requests", requests: []request{fail, fail, fail}, open: false},
+		{name: "slow requests", maxLatency: 10 * time.Millisecond, requests: []request{slow, ok, slow, ok}, open: true},
+		{name: "latency left out", requests: []request{slow, slow, slow, slow}, open: false},
+	} {
+		b := newBreakers(tt.maxLatency, time.Minute)
+		for _, r := range tt.requests {
+			if err := b.Allow(addr); err != nil {
+				t.Fatalf("%s: got %v before the circuit opened", tt.name, err)
+			}
+			b.Observe(addr, r.elapsed, r.err)
+		}
+		if open := b.Allow(addr) == ErrOpen; open != tt.open {
+			t.Errorf("%s: got open %v, want %v", tt.name, open, tt.open)
+		}
+	}
+}
+
+func TestCircuitWindowRestarts(t *testing.T) {
+	b := New(0.5, 0, 4, 20*time.Millisecond, time.Minute, metrics.Tags{"test": "breaker"})
+	for _, r := range []request{fail, fail, fail} {
+		b.Observe(addr, r.elapsed, r.err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	// Failures of the previous window are forgotten
+	for _, r := range []request{ok, ok, ok, fail} {
+		b.Observe(addr, r.elapsed, r.err)
+	}
+	if err := b.Allow(addr); err != nil {
+		t.Errorf("got %v, want the circuit closed", err)
+	}
+}
+
+func TestOpenCircuitLetsSingleTrialThrough(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		trial request
+		open  bool
+	}{
+		{name: "trial succeeds", trial: ok, open: false},
+		{name: "trial fails", trial: fail, open: true},
+	} {
+		b := newBreakers(0, 20*time.Millisecond)
+		for _, r := range []request{fail, fail, fail, fail} {
+			b.Observe(addr, r.elapsed, r.err)
+		}
+		if err := b.Allow(addr); err != ErrOpen {
+			t.Fatalf("%s: got %v during the open time, want %v", tt.name, err, ErrOpen)
+		}
+
+		time.Sleep(30 * time.Millisecond)
+		if err := b.Allow(addr); err != nil {
+			t.Fatalf("%s: got %v for the trial, want it let through", tt.name, err)
+		}
+		if err := b.Allow(addr); err != ErrOpen {
+			t.Errorf("%s: got %v during the trial, want %v", tt.name, err, ErrOpen)
+		}
+
+		b.Observe(addr, tt.trial.elapsed, tt.trial.err)
+		if open := b.Allow(addr) == ErrOpen; open != tt.open {
+			t.Errorf("%s: got open %v after the trial, want %v", tt.name, open, tt.open)
+		}
+		if !tt.open {
+			// A closed circuit starts counting anew
+			for _, r := range []request{fail, ok, ok} {
+				b.Observe(addr, r.elapsed, r.err)
+			}
+			if err := b.Allow(addr); err != nil {
+				t.Errorf("%s: got %v after closing, want the circuit closed", tt.name, err)
+			}
+		}
+	}
+}
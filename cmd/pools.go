@@ -0,0 +1,400 @@
+// Copyright © 2017 Barthelemy Vessemont
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/BarthV/epoxy/breaker"
+	"github.com/BarthV/epoxy/discovery"
+	"github.com/BarthV/epoxy/handlers/consulmemcached"
+	"github.com/BarthV/epoxy/handlers/multiget"
+	"github.com/BarthV/epoxy/handlers/router"
+	"github.com/BarthV/epoxy/handlers/shadow"
+	"github.com/BarthV/epoxy/hedge"
+	"github.com/BarthV/epoxy/orca"
+	"github.com/BarthV/epoxy/selector"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/spf13/viper"
+)
+
+// defaultPool serves the keys no route matches, it is configured by flags.
+const defaultPool = "default"
+
+// poolConfig describes a pool of memcached servers. Pools from the config
+// file take the settings they leave out from the default pool, and their
+// names are case insensitive. Routes are matched in order.
+//
+//	pools:
+//	  session:
+//	    consul-service: memcached-session
+//	    hash: fnv1a_64
+//	    timeout: 50ms
+//	    replicas: 2
+//	    gutter: gutter
+//	  gutter:
+//	    consul-service: memcached-gutter
+//	  shadow:
+//	    consul-service: memcached-next
+//	routes:
+//	  - prefix: "session:"
+//	    pool: session
+//	  - regex: "^feed:[0-9]+$"
+//	    pool: feed
+type poolConfig struct {
+	Discovery      string   `mapstructure:"discovery"`
+	ConsulService  string   `mapstructure:"consul-service"`
+	StaticServers  []string `mapstructure:"static-servers"`
+	DiscoveryFile  string   `mapstructure:"discovery-file"`
+	DNSName        string   `mapstructure:"dns-srv"`
+	DNSInterval    string   `mapstructure:"dns-interval"`
+	Distribution   string   `mapstructure:"distribution"`
+	Hash           string   `mapstructure:"hash"`
+	Timeout        string   `mapstructure:"timeout"`
+	GetFailureMode string   `mapstructure:"get-failure-mode"`
+	Replicas       int      `mapstructure:"replicas"`
+	Gutter         string   `mapstructure:"gutter"`
+	GutterTTL      string   `mapstructure:"gutter-ttl"`
+}
+
+// routeConfig sends the keys starting with Prefix, or matching Regex, to
+// the pool named Pool. A route has either a prefix or a regex.
+type routeConfig struct {
+	Prefix string `mapstructure:"prefix"`
+	Regex  string `mapstructure:"regex"`
+	Pool   string `mapstructure:"pool"`
+}
+
+// flagsPoolConfig returns the default pool configuration, from flags.
+func flagsPoolConfig() poolConfig {
+	return poolConfig{
+		Discovery:      viper.GetString("discovery"),
+		ConsulService:  viper.GetString("consul.service"),
+		StaticServers:  viper.GetStringSlice("static.servers"),
+		DiscoveryFile:  viper.GetString("file.path"),
+		DNSName:        viper.GetString("dns.name"),
+		DNSInterval:    viper.GetString("dns.interval"),
+		Distribution:   viper.GetString("distribution"),
+		Hash:           viper.GetString("hash"),
+		Timeout:        viper.GetString("timeout"),
+		GetFailureMode: viper.GetString("get-failure-mode"),
+		Replicas:       viper.GetInt("replicas"),
+		Gutter:         strings.ToLower(viper.GetString("gutter")),
+		GutterTTL:      viper.GetString("gutter-ttl"),
+	}
+}
+
+// inherit fills the settings c leaves out from def, but its gutter pool.
+func (c *poolConfig) inherit(def poolConfig) {
+	inheritString := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	inheritString(&c.Discovery, def.Discovery)
+	inheritString(&c.ConsulService, def.ConsulService)
+	inheritString(&c.DiscoveryFile, def.DiscoveryFile)
+	inheritString(&c.DNSName, def.DNSName)
+	inheritString(&c.DNSInterval, def.DNSInterval)
+	inheritString(&c.Distribution, def.Distribution)
+	inheritString(&c.Hash, def.Hash)
+	inheritString(&c.Timeout, def.Timeout)
+	inheritString(&c.GetFailureMode, def.GetFailureMode)
+	inheritString(&c.GutterTTL, def.GutterTTL)
+	if len(c.StaticServers) == 0 {
+		c.StaticServers = def.StaticServers
+	}
+	if c.Replicas == 0 {
+		c.Replicas = def.Replicas
+	}
+}
+
+// loadPools returns every pool configuration, by name, along with the
+// routes between them.
+func loadPools() (map[string]poolConfig, []router.Route) {
+	def := flagsPoolConfig()
+	pools := map[string]poolConfig{}
+	if err := viper.UnmarshalKey("pools", &pools); err != nil {
+		log.WithError(err).Fatal("pools")
+	}
+	for name, conf := range pools {
+		conf.inherit(def)
+		// viper lowercases pool names, references must follow
+		conf.Gutter = strings.ToLower(conf.Gutter)
+		pools[name] = conf
+	}
+	if _, ok := pools[defaultPool]; !ok {
+		pools[defaultPool] = def
+	}
+
+	var confs []routeConfig
+	if err := viper.UnmarshalKey("routes", &confs); err != nil {
+		log.WithError(err).Fatal("routes")
+	}
+	routes := make([]router.Route, len(confs))
+	for i, conf := range confs {
+		conf.Pool = strings.ToLower(conf.Pool)
+		if _, ok := pools[conf.Pool]; !ok {
+			log.WithField("pool", conf.Pool).Fatal("Route to an unknown pool")
+		}
+		if (conf.Prefix == "") == (conf.Regex == "") {
+			log.WithFields(log.Fields{
+				"pool":   conf.Pool,
+				"prefix": conf.Prefix,
+				"regex":  conf.Regex,
+			}).Fatal("Route needs either a prefix or a regex")
+		}
+		routes[i] = router.Route{Prefix: conf.Prefix, Pool: conf.Pool}
+		if conf.Regex != "" {
+			re, err := regexp.Compile(conf.Regex)
+			if err != nil {
+				log.WithError(err).WithField("regex", conf.Regex).Fatal("Invalid route regex")
+			}
+			routes[i].Regexp = re
+		}
+	}
+	return pools, routes
+}
+
+// duration parses the duration setting key of a pool.
+func duration(pool, key, value string) time.Duration {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.WithError(err).WithField("pool", pool).Fatal(key)
+	}
+	return d
+}
+
+// newPools returns every pool, by name, along with the policies the epoxy
+// orchestrator applies to it.
+func newPools(confs map[string]poolConfig) map[string]orca.Pool {
+	pools := make(map[string]orca.Pool, len(confs))
+	for name, conf := range confs {
+		name := name
+		pool := orca.Pool{
+			Replica:  conf.start(name),
+			Replicas: conf.Replicas,
+			Mode:     conf.mode(name),
+			Hedge: func(target string) *hedge.Delay {
+				return newHedge(name, target)
+			},
+		}
+		if conf.Gutter != "" {
+			if _, ok := confs[conf.Gutter]; !ok || conf.Gutter == name {
+				log.WithFields(log.Fields{
+					"pool":   name,
+					"gutter": conf.Gutter,
+				}).Fatal("Invalid gutter pool")
+			}
+			pool.Gutter = conf.Gutter
+			pool.GutterTTL = duration(name, "gutter-ttl", conf.GutterTTL)
+			if pool.GutterTTL < time.Second {
+				log.WithFields(log.Fields{
+					"pool":       name,
+					"gutter-ttl": pool.GutterTTL,
+				}).Fatal("Gutter TTL below a second, items would never expire")
+			}
+		}
+		pools[name] = pool
+	}
+	return pools
+}
+
+// newShadow returns the mirroring of requests to the shadow pool, nil when
+// requests are not mirrored.
+func newShadow(pools map[string]orca.Pool) *orca.Shadow {
+	name := strings.ToLower(viper.GetString("shadow.pool"))
+	if name == "" {
+		return nil
+	}
+	if _, ok := pools[name]; !ok {
+		log.WithField("shadow", name).Fatal("Unknown shadow pool")
+	}
+	rate := viper.GetFloat64("shadow.rate")
+	if rate <= 0 || rate > 1 {
+		log.WithField("shadow-rate", rate).Fatal("Shadow rate out of (0, 1]")
+	}
+	mode, ok := shadow.ParseMode(viper.GetString("shadow.mode"))
+	if !ok {
+		log.WithField("shadow-mode", viper.GetString("shadow.mode")).Fatal("Unknown shadow mode")
+	}
+	return &orca.Shadow{Pool: name, Rate: rate, Mode: mode}
+}
+
+// mode tells how keys failing on backend errors are answered.
+func (c poolConfig) mode(name string) multiget.Mode {
+	switch c.GetFailureMode {
+	case "miss":
+		return multiget.FailOpen
+	case "error":
+		return multiget.FailClosed
+	default:
+		log.WithFields(log.Fields{
+			"pool":             name,
+			"get-failure-mode": c.GetFailureMode,
+		}).Fatal("Unknown get failure mode")
+	}
+	return multiget.FailClosed
+}
+
+// start follows the membership of the pool named name and returns the
+// constructors of the handlers proxying requests to each replica of its keys.
+func (c poolConfig) start(name string) func(int, multiget.Mode) handlers.HandlerConst {
+	servers := c.newSelector(name)
+	var observers []func(net.Addr, time.Duration, error)
+	failures := viper.GetInt("eject.failures")
+	if failures > 0 && c.Distribution == "modula" {
+		// Under modula, ejecting a server would move nearly every key
+		log.WithField("pool", name).Warn("Server ejection needs the ketama distribution, disabled")
+		failures = 0
+	}
+	if failures > 0 {
+		ejector := selector.NewEjector(
+			servers,
+			failures,
+			viper.GetDuration("eject.cool-down"),
+			viper.GetFloat64("eject.max"),
+			metrics.Tags{"pool": name},
+		)
+		servers = ejector
+		observers = append(observers, ejector.Observe)
+	}
+	var allow func(net.Addr) error
+	if rate := viper.GetFloat64("breaker.error-rate"); rate > 0 {
+		breakers := breaker.New(
+			rate,
+			viper.GetDuration("breaker.latency"),
+			viper.GetInt("breaker.min-requests"),
+			viper.GetDuration("breaker.window"),
+			viper.GetDuration("breaker.open-time"),
+			metrics.Tags{"pool": name},
+		)
+		allow = breakers.Allow
+		observers = append(observers, breakers.Observe)
+	}
+	updates := make(chan []discovery.Member)
+
+	guard := discovery.NewGuard(
+		c.newDiscovery(name),
+		viper.GetInt("discovery.min-servers"),
+		viper.GetFloat64("discovery.max-removed"),
+		viper.GetDuration("discovery.max-hold"),
+	)
+	go guard.Watch(updates)
+	go consulmemcached.UpdateServers(servers, updates)
+	timeout := duration(name, "timeout", c.Timeout)
+	newClient := func(s memcache.ServerSelector) *memcache.Client {
+		mc := memcache.NewFromSelector(s)
+		mc.Timeout = timeout
+		mc.Allow = allow
+		if len(observers) > 0 {
+			mc.Observer = func(addr net.Addr, elapsed time.Duration, err error) {
+				for _, observe := range observers {
+					observe(addr, elapsed, err)
+				}
+			}
+		}
+		return mc
+	}
+
+	return func(i int, mode multiget.Mode) handlers.HandlerConst {
+		if c.Replicas <= 1 {
+			return consulmemcached.New(newClient(servers), mode)
+		}
+		// Each replica has its own client, talking to that replica of
+		// every key
+		return consulmemcached.New(newClient(selector.Replica(servers, i)), mode)
+	}
+}
+
+// newHedge returns the hedging delay of the reads of a pool from its
+// replicas, or gutter pool, nil when reads are not hedged.
+func newHedge(name, target string) *hedge.Delay {
+	percentile := viper.GetFloat64("hedge.percentile")
+	if percentile <= 0 {
+		return nil
+	}
+	if percentile > 1 {
+		log.WithField("hedge-percentile", percentile).Fatal("Hedge percentile above 1")
+	}
+	return hedge.NewDelay(
+		percentile,
+		viper.GetDuration("hedge.max-delay"),
+		metrics.Tags{"pool": name, "target": target},
+	)
+}
+
+// newSelector returns the key distribution and hash of the pool.
+func (c poolConfig) newSelector(name string) selector.Selector {
+	hashName := c.Hash
+	if hashName == "" {
+		hashName = "md5"
+		if c.Distribution == "modula" {
+			hashName = "crc32a"
+		}
+	}
+	hash, err := selector.ParseHash(hashName)
+	if err != nil {
+		log.WithError(err).WithField("pool", name).Fatal("Unknown key hash")
+	}
+
+	switch c.Distribution {
+	case "ketama":
+		return selector.NewKetama(hash)
+	case "modula":
+		return selector.NewModula(hash)
+	default:
+		log.WithFields(log.Fields{
+			"pool":         name,
+			"distribution": c.Distribution,
+		}).Fatal("Unknown key distribution")
+	}
+	return nil
+}
+
+// newDiscovery returns the discovery backend of the pool.
+func (c poolConfig) newDiscovery(name string) discovery.Discovery {
+	switch c.Discovery {
+	case "consul":
+		consul, err := discovery.NewConsul(
+			viper.GetString("consul.address"),
+			c.ConsulService,
+			viper.GetDuration("consul.wait-time"),
+		)
+		if err != nil {
+			log.WithError(err).WithField("pool", name).Fatal("Consul client creation failed")
+		}
+		return consul
+	case "static":
+		return discovery.NewStatic(c.StaticServers)
+	case "file":
+		return discovery.NewFile(c.DiscoveryFile)
+	case "dns":
+		return discovery.NewDNS(c.DNSName, duration(name, "dns-interval", c.DNSInterval))
+	default:
+		log.WithFields(log.Fields{
+			"pool":      name,
+			"discovery": c.Discovery,
+		}).Fatal("Unknown discovery backend")
+	}
+	return nil
+}
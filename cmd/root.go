@@ -68,6 +68,10 @@ func init() {
 	if err := viper.BindPFlag("consul.service", RootCmd.PersistentFlags().Lookup("consul-service")); err != nil {
 		log.WithError(err).Fatal("consul.service")
 	}
+	RootCmd.PersistentFlags().String("consul-wait-time", "5m", "maximum duration of consul blocking queries")
+	if err := viper.BindPFlag("consul.wait-time", RootCmd.PersistentFlags().Lookup("consul-wait-time")); err != nil {
+		log.WithError(err).Fatal("consul.wait-time")
+	}
 
 	RootCmd.PersistentFlags().Bool("profile", false, "Profile application")
 	if err := viper.BindPFlag("profile", RootCmd.PersistentFlags().Lookup("profile")); err != nil {
@@ -15,11 +15,13 @@
 package cmd
 
 import (
+	"net/http"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 
-	"github.com/BarthV/epoxy/handlers/consulmemcached"
-	"github.com/bradfitz/gomemcache/memcache"
-	consulApi "github.com/hashicorp/consul/api"
+	"github.com/BarthV/epoxy/handlers/lru"
+	"github.com/BarthV/epoxy/orca"
 	"github.com/netflix/rend/handlers"
 	"github.com/netflix/rend/orcas"
 	"github.com/netflix/rend/server"
@@ -33,7 +35,7 @@ var proxyCmd = &cobra.Command{
 	Use:   "proxy",
 	Short: "Run proxy server",
 	Long: `Proxify memcached request to cluster
-Request list to consul agent`,
+Request list to consul agent, or to another discovery backend`,
 	Run: proxy,
 }
 
@@ -49,6 +51,152 @@ func init() {
 	if err := viper.BindPFlag("timeout", proxyCmd.Flags().Lookup("timeout")); err != nil {
 		log.WithError(err).Fatal("timeout")
 	}
+
+	proxyCmd.Flags().String("orca", "epoxy", "Request orchestration: epoxy applies replication, gutter pools and shadowing and puts a short lived in process cache in front of pools, l1only proxies to pools, l1l2, l1l2batch and locked put an in process cache in front of them. Only epoxy supports replication, gutter pools and shadowing")
+	if err := viper.BindPFlag("orca", proxyCmd.Flags().Lookup("orca")); err != nil {
+		log.WithError(err).Fatal("orca")
+	}
+	proxyCmd.Flags().Int("l1-size", 64*1024*1024, "Memory in bytes used by the in process cache")
+	if err := viper.BindPFlag("l1-size", proxyCmd.Flags().Lookup("l1-size")); err != nil {
+		log.WithError(err).Fatal("l1-size")
+	}
+	proxyCmd.Flags().String("l1-ttl", "1s", "Longest duration items are served from the in process cache, at least 1s for the l1l2, l1l2batch and locked orcas. 0 disables the cache of the epoxy orca")
+	if err := viper.BindPFlag("l1-ttl", proxyCmd.Flags().Lookup("l1-ttl")); err != nil {
+		log.WithError(err).Fatal("l1-ttl")
+	}
+	proxyCmd.Flags().Int("locked-concurrency", 4, "The locked orca runs 2^N operations on distinct keys in parallel")
+	if err := viper.BindPFlag("locked-concurrency", proxyCmd.Flags().Lookup("locked-concurrency")); err != nil {
+		log.WithError(err).Fatal("locked-concurrency")
+	}
+
+	proxyCmd.Flags().Bool("coalesce", true, "Share one backend fetch among the gets of a key in flight at the same moment, across all connections")
+	if err := viper.BindPFlag("coalesce", proxyCmd.Flags().Lookup("coalesce")); err != nil {
+		log.WithError(err).Fatal("coalesce")
+	}
+
+	proxyCmd.Flags().String("get-failure-mode", "error", "Answer gets on backend failure with an error (fail closed) or a miss (fail open): one of error or miss")
+	if err := viper.BindPFlag("get-failure-mode", proxyCmd.Flags().Lookup("get-failure-mode")); err != nil {
+		log.WithError(err).Fatal("get-failure-mode")
+	}
+
+	proxyCmd.Flags().String("distribution", "ketama", "Key distribution among servers, as in twemproxy: ketama (consistent hashing, moving few keys on membership changes) or modula (hash modulo the number of servers, placing keys as before ketama was the default)")
+	if err := viper.BindPFlag("distribution", proxyCmd.Flags().Lookup("distribution")); err != nil {
+		log.WithError(err).Fatal("distribution")
+	}
+
+	proxyCmd.Flags().String("hash", "", "Key hash function, as in twemproxy: md5, crc32, crc32a, fnv1_32, fnv1a_32, fnv1_64, fnv1a_64 or murmur (default md5 for ketama, crc32a for modula)")
+	if err := viper.BindPFlag("hash", proxyCmd.Flags().Lookup("hash")); err != nil {
+		log.WithError(err).Fatal("hash")
+	}
+
+	proxyCmd.Flags().Int("replicas", 1, "Number of distinct servers storing each key: writes go to all of them, reads to the first healthy one")
+	if err := viper.BindPFlag("replicas", proxyCmd.Flags().Lookup("replicas")); err != nil {
+		log.WithError(err).Fatal("replicas")
+	}
+
+	proxyCmd.Flags().String("gutter", "", "Pool from the config file serving the keys of failed servers, none when empty")
+	if err := viper.BindPFlag("gutter", proxyCmd.Flags().Lookup("gutter")); err != nil {
+		log.WithError(err).Fatal("gutter")
+	}
+	proxyCmd.Flags().String("gutter-ttl", "10s", "Maximum expiration of items written to the gutter pool, at least 1s")
+	if err := viper.BindPFlag("gutter-ttl", proxyCmd.Flags().Lookup("gutter-ttl")); err != nil {
+		log.WithError(err).Fatal("gutter-ttl")
+	}
+
+	proxyCmd.Flags().Float64("hedge-percentile", 0.95, "Send the gets of replicated or gutter backed pools slower than this percentile of recent latencies to the next replica or gutter pool too, 0 to disable")
+	if err := viper.BindPFlag("hedge.percentile", proxyCmd.Flags().Lookup("hedge-percentile")); err != nil {
+		log.WithError(err).Fatal("hedge.percentile")
+	}
+	proxyCmd.Flags().String("hedge-max-delay", "20ms", "Maximum delay before hedging a get, also used until recent latencies are known")
+	if err := viper.BindPFlag("hedge.max-delay", proxyCmd.Flags().Lookup("hedge-max-delay")); err != nil {
+		log.WithError(err).Fatal("hedge.max-delay")
+	}
+
+	proxyCmd.Flags().String("shadow", "", "Pool from the config file receiving a copy of sampled requests, its answers to gets being compared with the primary ones, none when empty")
+	if err := viper.BindPFlag("shadow.pool", proxyCmd.Flags().Lookup("shadow")); err != nil {
+		log.WithError(err).Fatal("shadow.pool")
+	}
+	proxyCmd.Flags().Float64("shadow-rate", 0.01, "Fraction of the keys whose requests are copied to the shadow pool")
+	if err := viper.BindPFlag("shadow.rate", proxyCmd.Flags().Lookup("shadow-rate")); err != nil {
+		log.WithError(err).Fatal("shadow.rate")
+	}
+	proxyCmd.Flags().String("shadow-mode", "both", "Requests copied to the shadow pool: one of gets, sets or both")
+	if err := viper.BindPFlag("shadow.mode", proxyCmd.Flags().Lookup("shadow-mode")); err != nil {
+		log.WithError(err).Fatal("shadow.mode")
+	}
+
+	proxyCmd.Flags().String("discovery", "consul", "Cluster discovery backend: one of consul, static, file or dns")
+	if err := viper.BindPFlag("discovery", proxyCmd.Flags().Lookup("discovery")); err != nil {
+		log.WithError(err).Fatal("discovery")
+	}
+	proxyCmd.Flags().StringSlice("static-servers", []string{"127.0.0.1:11211"}, "Memcached servers of the static discovery")
+	if err := viper.BindPFlag("static.servers", proxyCmd.Flags().Lookup("static-servers")); err != nil {
+		log.WithError(err).Fatal("static.servers")
+	}
+	proxyCmd.Flags().String("discovery-file", "servers.yaml", "YAML or JSON servers file of the file discovery")
+	if err := viper.BindPFlag("file.path", proxyCmd.Flags().Lookup("discovery-file")); err != nil {
+		log.WithError(err).Fatal("file.path")
+	}
+	proxyCmd.Flags().String("dns-srv", "_memcached._tcp.service.consul", "SRV record name of the dns discovery")
+	if err := viper.BindPFlag("dns.name", proxyCmd.Flags().Lookup("dns-srv")); err != nil {
+		log.WithError(err).Fatal("dns.name")
+	}
+	proxyCmd.Flags().String("dns-interval", "10s", "SRV record polling interval of the dns discovery")
+	if err := viper.BindPFlag("dns.interval", proxyCmd.Flags().Lookup("dns-interval")); err != nil {
+		log.WithError(err).Fatal("dns.interval")
+	}
+
+	proxyCmd.Flags().Int("discovery-min-servers", 1, "Reject cluster updates with fewer servers")
+	if err := viper.BindPFlag("discovery.min-servers", proxyCmd.Flags().Lookup("discovery-min-servers")); err != nil {
+		log.WithError(err).Fatal("discovery.min-servers")
+	}
+	proxyCmd.Flags().Float64("discovery-max-removed", 0.5, "Reject cluster updates removing a larger fraction of the servers at once")
+	if err := viper.BindPFlag("discovery.max-removed", proxyCmd.Flags().Lookup("discovery-max-removed")); err != nil {
+		log.WithError(err).Fatal("discovery.max-removed")
+	}
+	proxyCmd.Flags().String("discovery-max-hold", "10m", "Accept rejected cluster updates anyway once rejected for this long, 0 to never accept them")
+	if err := viper.BindPFlag("discovery.max-hold", proxyCmd.Flags().Lookup("discovery-max-hold")); err != nil {
+		log.WithError(err).Fatal("discovery.max-hold")
+	}
+
+	proxyCmd.Flags().Int("eject-failures", 0, "Eject a server from the hash ring after this many failures in a row, 0 to disable. Needs the ketama distribution, under which ejecting a server only moves its own keys")
+	if err := viper.BindPFlag("eject.failures", proxyCmd.Flags().Lookup("eject-failures")); err != nil {
+		log.WithError(err).Fatal("eject.failures")
+	}
+	proxyCmd.Flags().String("eject-cool-down", "10s", "Delay between probes of an ejected server, before putting it back")
+	if err := viper.BindPFlag("eject.cool-down", proxyCmd.Flags().Lookup("eject-cool-down")); err != nil {
+		log.WithError(err).Fatal("eject.cool-down")
+	}
+	proxyCmd.Flags().Float64("eject-max", 0.3, "Maximum fraction of the servers of a pool ejected at once, rounded up")
+	if err := viper.BindPFlag("eject.max", proxyCmd.Flags().Lookup("eject-max")); err != nil {
+		log.WithError(err).Fatal("eject.max")
+	}
+
+	proxyCmd.Flags().Float64("breaker-error-rate", 0.5, "Open the circuit of a server when this fraction of its requests fail or are slow, 0 to disable")
+	if err := viper.BindPFlag("breaker.error-rate", proxyCmd.Flags().Lookup("breaker-error-rate")); err != nil {
+		log.WithError(err).Fatal("breaker.error-rate")
+	}
+	proxyCmd.Flags().String("breaker-latency", "0s", "Count requests slower than this as failures for circuit breakers, 0 to disable")
+	if err := viper.BindPFlag("breaker.latency", proxyCmd.Flags().Lookup("breaker-latency")); err != nil {
+		log.WithError(err).Fatal("breaker.latency")
+	}
+	proxyCmd.Flags().Int("breaker-min-requests", 20, "Minimum number of requests in a window before a circuit may open")
+	if err := viper.BindPFlag("breaker.min-requests", proxyCmd.Flags().Lookup("breaker-min-requests")); err != nil {
+		log.WithError(err).Fatal("breaker.min-requests")
+	}
+	proxyCmd.Flags().String("breaker-window", "10s", "Duration over which circuit breakers count requests")
+	if err := viper.BindPFlag("breaker.window", proxyCmd.Flags().Lookup("breaker-window")); err != nil {
+		log.WithError(err).Fatal("breaker.window")
+	}
+	proxyCmd.Flags().String("breaker-open-time", "5s", "Duration an open circuit fails requests fast before letting a trial through")
+	if err := viper.BindPFlag("breaker.open-time", proxyCmd.Flags().Lookup("breaker-open-time")); err != nil {
+		log.WithError(err).Fatal("breaker.open-time")
+	}
+
+	proxyCmd.Flags().String("metrics-listen", "", "Address serving metrics over HTTP on /metrics, such as 127.0.0.1:11299, empty to disable")
+	if err := viper.BindPFlag("metrics-listen", proxyCmd.Flags().Lookup("metrics-listen")); err != nil {
+		log.WithError(err).Fatal("metrics-listen")
+	}
 }
 
 func proxy(cmd *cobra.Command, args []string) {
@@ -56,12 +204,66 @@ func proxy(cmd *cobra.Command, args []string) {
 		defer profile.Start().Stop()
 	}
 
-	var MemcachedList memcache.ServerList
-	var consulOptions = consulApi.QueryOptions{}
+	if addr := viper.GetString("metrics-listen"); addr != "" {
+		go func() {
+			// rend registers its /metrics handler on the default mux
+			err := http.ListenAndServe(addr, nil)
+			log.WithError(err).Error("Metrics server stopped")
+		}()
+	}
+
+	confs, routes := loadPools()
+	conf := orca.Config{
+		L1TTL:    viper.GetDuration("l1-ttl"),
+		Pools:    newPools(confs),
+		Routes:   routes,
+		Default:  defaultPool,
+		Coalesce: viper.GetBool("coalesce"),
+	}
+	conf.Shadow = newShadow(conf.Pools)
 
-	go consulmemcached.ConsulPoller(&MemcachedList, consulOptions)
-	mc := memcache.NewFromSelector(&MemcachedList)
-	mc.Timeout = viper.GetDuration("timeout")
+	name := viper.GetString("orca")
+	if name != "epoxy" && conf.Policies() {
+		log.WithField("orca", name).Fatal("Replication, gutter pools and shadowing need the epoxy orca")
+	}
+	var oc orcas.OrcaConst
+	l1, l2 := conf.L2(), handlers.HandlerConst(handlers.NilHandler)
+	switch name {
+	case "epoxy":
+		oc = orca.Epoxy(conf)
+		if conf.L1TTL > 0 {
+			l1, l2 = lru.New(lru.NewCache(viper.GetInt("l1-size"), conf.L1TTL)), l1
+		} else {
+			// Pools are the L2 all the same
+			l1, l2 = l2, l1
+		}
+	case "l1only":
+		oc = orcas.L1Only
+	case "l1l2", "l1l2batch", "locked":
+		switch name {
+		case "l1l2":
+			oc = orcas.L1L2
+		case "l1l2batch":
+			oc = orcas.L1L2Batch
+		case "locked":
+			// Readers of a key share its lock, keeping the L1 consistent.
+			// The lockset ID only serves sharing locks with other orcas,
+			// this one is alone taking them.
+			oc, _ = orcas.Locked(orcas.L1L2, true, uint8(viper.GetInt("locked-concurrency")))
+		}
+		// Pools become the L2 of an in process cache. Its items must expire
+		// for writes through other proxies to show up, whatever the TTLs
+		// read from pools.
+		if conf.L1TTL < time.Second {
+			log.WithFields(log.Fields{
+				"orca":   name,
+				"l1-ttl": conf.L1TTL,
+			}).Fatal("In process cache TTL below a second")
+		}
+		l1, l2 = lru.New(lru.NewCache(viper.GetInt("l1-size"), conf.L1TTL)), l1
+	default:
+		log.WithField("orca", name).Fatal("Unknown orca")
+	}
 
 	server.ListenAndServe(
 		server.ListenArgs{
@@ -69,8 +271,8 @@ func proxy(cmd *cobra.Command, args []string) {
 			Port: viper.GetInt("port"),
 		},
 		server.Default,
-		orcas.L1Only,
-		consulmemcached.New(mc),
-		handlers.NilHandler,
+		oc,
+		l1,
+		l2,
 	)
 }
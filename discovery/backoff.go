@@ -0,0 +1,39 @@
+package discovery
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff computes exponentially growing delays between retries of a failing
+// query. Delays are jittered so that many proxies don't hammer a recovering
+// server in lockstep.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt uint
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{
+		min: min,
+		max: max,
+	}
+}
+
+// next returns the delay to wait before the next retry, somewhere between
+// half and all of the current exponential step.
+func (b *backoff) next() time.Duration {
+	d := b.min << b.attempt
+	if d <= 0 || d >= b.max {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// reset starts over from the minimum delay, once a query succeeded.
+func (b *backoff) reset() {
+	b.attempt = 0
+}
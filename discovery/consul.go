@@ -0,0 +1,127 @@
+package discovery
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// consulWeightKey names the service meta field, or the key=value
+	// service tag, holding the weight of an instance.
+	consulWeightKey = "weight"
+
+	consulMinBackoff = 500 * time.Millisecond
+	consulMaxBackoff = 30 * time.Second
+)
+
+// Consul discovers the healthy instances of a Consul service, following
+// changes with blocking queries.
+type Consul struct {
+	client   *api.Client
+	service  string
+	waitTime time.Duration
+
+	// minBackoff and maxBackoff bound the delay between retries of failed
+	// queries.
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// NewConsul returns the discovery of service through the Consul agent at
+// address. Blocking queries wait at most waitTime for a change before
+// being issued again.
+func NewConsul(address, service string, waitTime time.Duration) (*Consul, error) {
+	consulconf := api.DefaultConfig()
+	consulconf.Address = address
+	client, err := api.NewClient(consulconf)
+	if err != nil {
+		return nil, err
+	}
+	return &Consul{
+		client:     client,
+		service:    service,
+		waitTime:   waitTime,
+		minBackoff: consulMinBackoff,
+		maxBackoff: consulMaxBackoff,
+	}, nil
+}
+
+func (c *Consul) Watch(updates chan<- []Member) {
+	consulOptions := api.QueryOptions{WaitTime: c.waitTime}
+	retry := newBackoff(c.minBackoff, c.maxBackoff)
+
+	for {
+		res, resqry, err := c.client.Health().Service(c.service, "", true, &consulOptions)
+		if err == nil && resqry == nil {
+			err = errMissingQueryMeta
+		}
+		if err != nil {
+			delay := retry.next()
+			log.WithError(err).WithField("retry", delay).Error("Consul Services query failed")
+			// Start over with a non blocking query, the index may belong
+			// to another consul server now
+			consulOptions.WaitIndex = 0
+			time.Sleep(delay)
+			continue
+		}
+		retry.reset()
+
+		if resqry.LastIndex == consulOptions.WaitIndex {
+			// Blocking query timed out without any change
+			continue
+		}
+		if resqry.LastIndex < consulOptions.WaitIndex {
+			// Raft index went backwards, start over from scratch
+			consulOptions.WaitIndex = 0
+		} else {
+			consulOptions.WaitIndex = resqry.LastIndex
+		}
+
+		members := make([]Member, 0, len(res))
+		for _, service := range res {
+			ip := service.Service.Address
+			if ip == "" {
+				ip = service.Node.Address
+			}
+			members = append(members, Member{
+				// Service IDs are only unique on their node
+				ID:      service.Node.Node + "/" + service.Service.ID,
+				Address: ip + ":" + strconv.Itoa(service.Service.Port),
+				Weight:  consulWeight(service.Service),
+			})
+		}
+		updates <- members
+	}
+}
+
+// consulWeight reads the weight of a service instance from its meta, or
+// else from its tags. Instances without a valid weight get the default one.
+func consulWeight(service *api.AgentService) int {
+	value, ok := service.Meta[consulWeightKey]
+	if !ok {
+		for _, tag := range service.Tags {
+			if strings.HasPrefix(tag, consulWeightKey+"=") {
+				value, ok = strings.TrimPrefix(tag, consulWeightKey+"="), true
+				break
+			}
+		}
+	}
+	if !ok {
+		return 0
+	}
+
+	weight, err := strconv.Atoi(value)
+	if err != nil || weight < 1 {
+		log.WithFields(log.Fields{
+			"service": service.ID,
+			"weight":  value,
+		}).Warn("Invalid consul service weight, using default")
+		return 0
+	}
+	return weight
+}
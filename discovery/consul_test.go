@@ -0,0 +1,154 @@
+package discovery
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// consulReply is the answer of the fake consul agent to a health query: an
+// outage when status is set, or else the instances at index.
+type consulReply struct {
+	status    int
+	index     uint64
+	instances []string
+}
+
+// fakeConsul is a consul agent answering health queries with its replies
+// in turn, recording the index each query waits on. Once out of replies,
+// queries block until the test ends.
+type fakeConsul struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	replies []consulReply
+	indexes []string
+}
+
+func newFakeConsul(t *testing.T, replies ...consulReply) *fakeConsul {
+	f := &fakeConsul{replies: replies}
+	done := make(chan struct{})
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/memcached" || r.URL.Query().Get("passing") != "1" {
+			http.NotFound(w, r)
+			return
+		}
+
+		f.mu.Lock()
+		f.indexes = append(f.indexes, r.URL.Query().Get("index"))
+		if len(f.replies) == 0 {
+			f.mu.Unlock()
+			<-done
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		reply := f.replies[0]
+		f.replies = f.replies[1:]
+		f.mu.Unlock()
+
+		if reply.status != 0 {
+			w.WriteHeader(reply.status)
+			return
+		}
+		entries := make([]string, len(reply.instances))
+		for i, instance := range reply.instances {
+			entries[i] = fmt.Sprintf(
+				`{"Node": {"Node": "node-%s", "Address": "10.0.0.%d"}, "Service": {"ID": "%s", "Port": 11211}}`,
+				instance, i+1, instance)
+		}
+		w.Header().Set("X-Consul-Index", fmt.Sprint(reply.index))
+		w.Header().Set("X-Consul-LastContact", "0")
+		w.Header().Set("X-Consul-KnownLeader", "true")
+		fmt.Fprintf(w, "[%s]", strings.Join(entries, ","))
+	}))
+	t.Cleanup(f.Server.Close)
+	t.Cleanup(func() { close(done) })
+	return f
+}
+
+func (f *fakeConsul) waited() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.indexes...)
+}
+
+func TestConsulWatch(t *testing.T) {
+	fake := newFakeConsul(t,
+		// The agent is down at first
+		consulReply{status: http.StatusInternalServerError},
+		consulReply{index: 10, instances: []string{"a"}},
+		// Blocking query timing out without change
+		consulReply{index: 10, instances: []string{"a"}},
+		// The agent fails again, the index may be stale once back
+		consulReply{status: http.StatusInternalServerError},
+		consulReply{index: 12, instances: []string{"a", "b"}},
+		// The raft index went backwards
+		consulReply{index: 3, instances: []string{"b"}},
+		consulReply{index: 3, instances: []string{"b"}},
+	)
+
+	c, err := NewConsul(strings.TrimPrefix(fake.URL, "http://"), "memcached", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.minBackoff = time.Millisecond
+	c.maxBackoff = 10 * time.Millisecond
+
+	updates := make(chan []Member)
+	go c.Watch(updates)
+
+	want := [][]Member{
+		{{ID: "node-a/a", Address: "10.0.0.1:11211"}},
+		{{ID: "node-a/a", Address: "10.0.0.1:11211"}, {ID: "node-b/b", Address: "10.0.0.2:11211"}},
+		{{ID: "node-b/b", Address: "10.0.0.1:11211"}},
+		{{ID: "node-b/b", Address: "10.0.0.1:11211"}},
+	}
+	for i, members := range want {
+		select {
+		case got := <-updates:
+			if !reflect.DeepEqual(got, members) {
+				t.Errorf("update %d: got %+v, want %+v", i, got, members)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("update %d: timed out", i)
+		}
+	}
+	select {
+	case got := <-updates:
+		t.Errorf("got unexpected update %+v", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Failures and index resets start over with non blocking queries
+	wantIndexes := []string{"", "", "10", "10", "", "12", "", "3"}
+	if got := fake.waited(); !reflect.DeepEqual(got, wantIndexes) {
+		t.Errorf("got queries waiting on indexes %q, want %q", got, wantIndexes)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(100*time.Millisecond, time.Second)
+	steps := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, step := range steps {
+		if d := b.next(); d < step/2 || d > step {
+			t.Errorf("retry %d: got %v, want between %v and %v", i, d, step/2, step)
+		}
+	}
+
+	b.reset()
+	if d := b.next(); d < 50*time.Millisecond || d > 100*time.Millisecond {
+		t.Errorf("after reset: got %v, want between 50ms and 100ms", d)
+	}
+}
@@ -0,0 +1,50 @@
+// Package discovery finds the memcached servers making up a cluster and
+// follows membership changes.
+package discovery
+
+import (
+	"errors"
+	"sort"
+)
+
+var errMissingQueryMeta = errors.New("discovery: consul query returned no metadata")
+
+// Member is a memcached server of a cluster.
+type Member struct {
+	// ID identifies the server across updates, whatever its address.
+	ID string
+	// Address is the host:port the server listens on.
+	Address string
+	// Weight is the share of the keyspace the server owns relative to
+	// other members, 0 standing for the default weight of 1.
+	Weight int
+}
+
+// Discovery follows the membership of a memcached cluster.
+type Discovery interface {
+	// Watch sends the whole membership on updates each time it may have
+	// changed. It blocks forever and is meant to run in its own goroutine.
+	Watch(updates chan<- []Member)
+}
+
+// Addresses returns the address of each member.
+func Addresses(members []Member) []string {
+	addrs := make([]string, len(members))
+	for i, m := range members {
+		addrs[i] = m.Address
+	}
+	return addrs
+}
+
+// SortByID orders members by identity. Key placement depends on the order
+// of servers, sorting keeps it stable whatever order a backend returned
+// an unchanged membership in.
+func SortByID(members []Member) {
+	sort.Sort(byID(members))
+}
+
+type byID []Member
+
+func (m byID) Len() int           { return len(m) }
+func (m byID) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byID) Less(i, j int) bool { return m[i].ID < m[j].ID }
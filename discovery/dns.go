@@ -0,0 +1,44 @@
+package discovery
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DNS discovers servers through the SRV records of a name, polled at a fixed
+// interval.
+type DNS struct {
+	name     string
+	interval time.Duration
+}
+
+func NewDNS(name string, interval time.Duration) *DNS {
+	return &DNS{
+		name:     name,
+		interval: interval,
+	}
+}
+
+func (d *DNS) Watch(updates chan<- []Member) {
+	for {
+		_, srvs, err := net.LookupSRV("", "", d.name)
+		if err != nil {
+			log.WithError(err).WithField("name", d.name).Error("DNS SRV lookup failed")
+		} else {
+			members := make([]Member, len(srvs))
+			for i, srv := range srvs {
+				addr := strings.TrimSuffix(srv.Target, ".") + ":" + strconv.Itoa(int(srv.Port))
+				members[i] = Member{
+					ID:      addr,
+					Address: addr,
+				}
+			}
+			updates <- members
+		}
+		time.Sleep(d.interval)
+	}
+}
@@ -0,0 +1,76 @@
+package discovery
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v2"
+)
+
+// File reads the server list from a YAML or JSON file and reloads it each
+// time it changes. The file holds a "servers" list of addresses:
+//
+//	servers:
+//	  - 10.0.0.1:11211
+//	  - 10.0.0.2:11211
+type File struct {
+	path string
+}
+
+type fileContent struct {
+	Servers []string `yaml:"servers"`
+}
+
+func NewFile(path string) *File {
+	return &File{
+		path: path,
+	}
+}
+
+func (f *File) Watch(updates chan<- []Member) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.WithError(err).Fatal("Discovery file watcher creation failed")
+	}
+	defer watcher.Close()
+
+	// Watching the directory rather than the file survives editors and
+	// config management tools replacing the file instead of writing it.
+	if err := watcher.Add(filepath.Dir(f.path)); err != nil {
+		log.WithError(err).WithField("path", f.path).Fatal("Discovery file watch failed")
+	}
+
+	f.load(updates)
+	for {
+		select {
+		case event := <-watcher.Events:
+			if filepath.Clean(event.Name) != filepath.Clean(f.path) {
+				continue
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) != 0 {
+				f.load(updates)
+			}
+		case err := <-watcher.Errors:
+			log.WithError(err).WithField("path", f.path).Error("Discovery file watch error")
+		}
+	}
+}
+
+func (f *File) load(updates chan<- []Member) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		log.WithError(err).WithField("path", f.path).Error("Discovery file read failed")
+		return
+	}
+
+	// YAML being a superset of JSON, both are parsed the same way
+	var content fileContent
+	if err := yaml.Unmarshal(data, &content); err != nil {
+		log.WithError(err).WithField("path", f.path).Error("Discovery file parsing failed")
+		return
+	}
+	updates <- staticMembers(content.Servers)
+}
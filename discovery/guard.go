@@ -0,0 +1,129 @@
+package discovery
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricUpdatesAccepted = metrics.AddCounter("discovery_updates_accepted", nil)
+	MetricUpdatesRejected = metrics.AddCounter("discovery_updates_rejected", nil)
+)
+
+// Guard wraps a Discovery to hold back membership updates that would
+// collapse the cluster, such as a flapping health check briefly reporting
+// no or few healthy servers. The last good membership is kept while
+// suspicious updates are reported.
+type Guard struct {
+	wrapped    Discovery
+	minServers int
+	maxRemoved float64
+	maxHold    time.Duration
+}
+
+// NewGuard returns a Guard rejecting updates with fewer than minServers
+// servers, or removing more than the maxRemoved fraction of the current
+// servers at once. Once updates removing too many servers have been
+// rejected for maxHold, the latest one is trusted anyway so that deliberate
+// shrinks eventually go through, even from backends sending it only once. A zero maxHold holds the last good
+// membership forever. Updates with too few servers are always rejected.
+func NewGuard(wrapped Discovery, minServers int, maxRemoved float64, maxHold time.Duration) *Guard {
+	return &Guard{
+		wrapped:    wrapped,
+		minServers: minServers,
+		maxRemoved: maxRemoved,
+		maxHold:    maxHold,
+	}
+}
+
+func (g *Guard) Watch(updates chan<- []Member) {
+	in := make(chan []Member)
+	go g.wrapped.Watch(in)
+
+	var current, pending []Member
+	// release fires once pending, removing too many servers, has been held
+	// for maxHold, as backends may never send it again
+	var hold *time.Timer
+	var release <-chan time.Time
+	stopHold := func() {
+		if hold != nil {
+			hold.Stop()
+		}
+		hold, release, pending = nil, nil, nil
+	}
+	defer stopHold()
+
+	accept := func(members []Member) {
+		metrics.IncCounter(MetricUpdatesAccepted)
+		current = members
+		updates <- members
+	}
+
+	for {
+		select {
+		case members, ok := <-in:
+			if !ok {
+				return
+			}
+			if len(members) < g.minServers {
+				metrics.IncCounter(MetricUpdatesRejected)
+				log.WithFields(log.Fields{
+					"current": len(current),
+					"update":  len(members),
+					"min":     g.minServers,
+				}).Error("Cluster update with too few servers rejected, keeping last good membership")
+				continue
+			}
+
+			if g.tooManyRemoved(current, members) {
+				pending = members
+				if hold == nil && g.maxHold > 0 {
+					hold = time.NewTimer(g.maxHold)
+					release = hold.C
+				}
+				metrics.IncCounter(MetricUpdatesRejected)
+				log.WithFields(log.Fields{
+					"current": len(current),
+					"update":  len(members),
+				}).Error("Cluster update removing too many servers rejected, keeping last good membership")
+				continue
+			}
+
+			stopHold()
+			accept(members)
+
+		case <-release:
+			members := pending
+			stopHold()
+			log.WithFields(log.Fields{
+				"current": len(current),
+				"update":  len(members),
+				"held":    g.maxHold,
+			}).Warn("Cluster update removing too many servers held for too long, accepting it")
+			accept(members)
+		}
+	}
+}
+
+// tooManyRemoved tells whether members removes more than the maxRemoved
+// fraction of the current servers.
+func (g *Guard) tooManyRemoved(current, members []Member) bool {
+	if len(current) == 0 {
+		return false
+	}
+
+	ids := make(map[string]bool, len(members))
+	for _, m := range members {
+		ids[m.ID] = true
+	}
+	removed := 0
+	for _, m := range current {
+		if !ids[m.ID] {
+			removed++
+		}
+	}
+	return float64(removed)/float64(len(current)) > g.maxRemoved
+}
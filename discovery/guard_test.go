@@ -0,0 +1,57 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+)
+
+// feed is a discovery passing on the memberships sent to it.
+type feed chan []Member
+
+func (f feed) Watch(updates chan<- []Member) {
+	for members := range f {
+		updates <- members
+	}
+	close(updates)
+}
+
+func servers(ids ...string) []Member {
+	members := make([]Member, len(ids))
+	for i, id := range ids {
+		members[i] = Member{ID: id, Address: id + ":11211"}
+	}
+	return members
+}
+
+func TestGuardHoldNeverOverridesMinServers(t *testing.T) {
+	in := make(feed)
+	updates := make(chan []Member)
+	go NewGuard(in, 2, 0.25, 10*time.Millisecond).Watch(updates)
+
+	in <- servers("a", "b", "c", "d")
+	if got := <-updates; len(got) != 4 {
+		t.Fatalf("got %d servers, want the first update of 4", len(got))
+	}
+
+	// Removing too many servers is held back, then trusted without being
+	// sent again
+	in <- servers("a")
+	in <- servers("a", "b")
+	select {
+	case got := <-updates:
+		if len(got) != 2 {
+			t.Fatalf("got %d servers, want the held update of 2", len(got))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("held update never accepted")
+	}
+
+	// Too few servers are rejected however long they last
+	in <- servers()
+	time.Sleep(20 * time.Millisecond)
+	in <- servers("c")
+	in <- servers("a", "b", "c")
+	if got := <-updates; len(got) != 3 {
+		t.Fatalf("got %d servers, want the update of 3", len(got))
+	}
+}
@@ -0,0 +1,30 @@
+package discovery
+
+// Static is a fixed list of servers, mostly useful for development and tests.
+type Static struct {
+	servers []string
+}
+
+func NewStatic(servers []string) *Static {
+	return &Static{
+		servers: servers,
+	}
+}
+
+func (s *Static) Watch(updates chan<- []Member) {
+	updates <- staticMembers(s.servers)
+	select {}
+}
+
+// staticMembers builds members out of plain addresses, each address being
+// its own identity.
+func staticMembers(servers []string) []Member {
+	members := make([]Member, len(servers))
+	for i, server := range servers {
+		members[i] = Member{
+			ID:      server,
+			Address: server,
+		}
+	}
+	return members
+}
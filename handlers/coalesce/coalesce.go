@@ -0,0 +1,243 @@
+// Package coalesce provides a handler sharing the backend fetch of a key
+// among all the gets of that key in flight at the same moment, whatever
+// the client connection they come from. A hot key read by many clients at
+// once then costs a single backend request. Gets and getEs are coalesced
+// apart.
+package coalesce
+
+import (
+	"sync"
+
+	"github.com/BarthV/epoxy/handlers/multiget"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricKeys   = metrics.AddCounter("coalesce_keys", nil)
+	MetricShared = metrics.AddCounter("coalesce_shared", nil)
+	MetricFlying = metrics.AddIntGauge("coalesce_in_flight", nil)
+)
+
+// flightKey tells fetches apart. Gets asking for CAS uniques do not share
+// fetches with the others, which are answered without them.
+type flightKey struct {
+	key string
+	cas bool
+}
+
+// flight is a backend fetch of a key, shared by the gets joining it until
+// it is done. When the key was not answered, err tells why.
+type flight[R multiget.Response] struct {
+	done     chan struct{}
+	res      R
+	answered bool
+	err      error
+}
+
+// group holds the fetches in flight, it is shared by all handlers.
+type group[R multiget.Response] struct {
+	mu      sync.Mutex
+	flights map[flightKey]*flight[R]
+}
+
+func newGroup[R multiget.Response]() *group[R] {
+	return &group[R]{flights: make(map[flightKey]*flight[R])}
+}
+
+// Handler coalesces the gets and getEs of its connection with the ones of
+// every other handler from the same constructor.
+type Handler struct {
+	gets    *group[common.GetResponse]
+	getEs   *group[common.GetEResponse]
+	wrapped handlers.Handler
+}
+
+// New returns the constructor of handlers coalescing gets before passing
+// them to the handlers of wrapped. Other requests are passed as is.
+func New(wrapped handlers.HandlerConst) handlers.HandlerConst {
+	gets := newGroup[common.GetResponse]()
+	getEs := newGroup[common.GetEResponse]()
+	return func() (handlers.Handler, error) {
+		w, err := wrapped()
+		if err != nil {
+			return nil, err
+		}
+		return &Handler{
+			gets:    gets,
+			getEs:   getEs,
+			wrapped: w,
+		}, nil
+	}
+}
+
+// join returns the fetch in flight for key, and whether it was started by
+// another get. Otherwise the caller leads a new one and must land it.
+func (g *group[R]) join(key flightKey) (*flight[R], bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.flights[key]; ok {
+		return f, true
+	}
+	f := &flight[R]{done: make(chan struct{})}
+	g.flights[key] = f
+	metrics.SetIntGauge(MetricFlying, uint64(len(g.flights)))
+	return f, false
+}
+
+// land ends the fetch f of key, releasing the gets that joined it.
+func (g *group[R]) land(key flightKey, f *flight[R]) {
+	g.forget(key, f)
+	close(f.done)
+}
+
+// forget makes the later gets of key start a new fetch, instead of joining
+// f. A nil f forgets any fetch.
+func (g *group[R]) forget(key flightKey, f *flight[R]) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if cur, ok := g.flights[key]; ok && (f == nil || cur == f) {
+		delete(g.flights, key)
+		metrics.SetIntGauge(MetricFlying, uint64(len(g.flights)))
+	}
+}
+
+// written makes sure gets following a write of key do not get an answer
+// fetched before it.
+func (h *Handler) written(key []byte) {
+	for _, cas := range []bool{false, true} {
+		h.gets.forget(flightKey{key: string(key), cas: cas}, nil)
+		h.getEs.forget(flightKey{key: string(key), cas: cas}, nil)
+	}
+}
+
+func (h *Handler) Set(cmd common.SetRequest) error {
+	defer h.written(cmd.Key)
+	return h.wrapped.Set(cmd)
+}
+
+func (h *Handler) Add(cmd common.SetRequest) error {
+	defer h.written(cmd.Key)
+	return h.wrapped.Add(cmd)
+}
+
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	defer h.written(cmd.Key)
+	return h.wrapped.Replace(cmd)
+}
+
+func (h *Handler) Append(cmd common.SetRequest) error {
+	defer h.written(cmd.Key)
+	return h.wrapped.Append(cmd)
+}
+
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	defer h.written(cmd.Key)
+	return h.wrapped.Prepend(cmd)
+}
+
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	return get(h.gets, cmd, h.wrapped.Get)
+}
+
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	return get(h.getEs, cmd, h.wrapped.GetE)
+}
+
+// get fetches with wrapped, in a single batch, the keys of cmd no other get
+// of g is fetching, then waits for the fetches it joined. Responses keep the
+// order of the keys. When a fetch failed, the get fails as a whole rather
+// than answering the other keys.
+func get[R multiget.Response](g *group[R], cmd common.GetRequest, wrapped func(common.GetRequest) (<-chan R, <-chan error)) (<-chan R, <-chan error) {
+	metrics.IncCounterBy(MetricKeys, uint64(len(cmd.Keys)))
+
+	flights := make([]*flight[R], len(cmd.Keys))
+	var led []*flight[R]
+	lead := common.GetRequest{Cas: cmd.Cas, CasOptional: cmd.CasOptional}
+	for idx, key := range cmd.Keys {
+		f, shared := g.join(flightKey{key: string(key), cas: cmd.Cas})
+		flights[idx] = f
+		if shared {
+			metrics.IncCounter(MetricShared)
+			continue
+		}
+		led = append(led, f)
+		lead.Keys = append(lead.Keys, key)
+		lead.Opaques = append(lead.Opaques, cmd.Opaques[idx])
+		lead.Quiet = append(lead.Quiet, cmd.Quiet[idx])
+	}
+
+	if len(lead.Keys) > 0 {
+		fetch(g, lead, led, wrapped)
+	}
+
+	res := multiget.NewResult[R](cmd)
+	for idx, f := range flights {
+		<-f.done
+		if f.answered {
+			res.Responses[idx] = relabel(f.res, cmd, idx)
+			res.Answered[idx] = true
+		} else if f.err != nil {
+			res.Err = f.err
+		}
+	}
+	return multiget.Reply(cmd, res, multiget.FailClosed)
+}
+
+// fetch gets the keys of cmd with wrapped and lands the fetches it leads,
+// one per key. Keys left unanswered get the error of wrapped, or a miss.
+func fetch[R multiget.Response](g *group[R], cmd common.GetRequest, led []*flight[R], wrapped func(common.GetRequest) (<-chan R, <-chan error)) {
+	data, errors := wrapped(cmd)
+	res := multiget.Read(cmd, data, errors)
+	for i, f := range led {
+		if res.Answered[i] {
+			f.res = res.Responses[i]
+			f.answered = true
+		} else {
+			f.err = res.Err
+		}
+		g.land(flightKey{key: string(cmd.Keys[i]), cas: cmd.Cas}, f)
+	}
+}
+
+// relabel returns res, fetched for another get, as the answer to the key at
+// idx in cmd.
+func relabel[R multiget.Response](res R, cmd common.GetRequest, idx int) R {
+	switch r := any(&res).(type) {
+	case *common.GetResponse:
+		r.Key, r.Opaque, r.Quiet = cmd.Keys[idx], cmd.Opaques[idx], cmd.Quiet[idx]
+	case *common.GetEResponse:
+		r.Key, r.Opaque, r.Quiet = cmd.Keys[idx], cmd.Opaques[idx], cmd.Quiet[idx]
+	}
+	return res
+}
+
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	defer h.written(cmd.Key)
+	return h.wrapped.GAT(cmd)
+}
+
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	defer h.written(cmd.Key)
+	return h.wrapped.Delete(cmd)
+}
+
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	defer h.written(cmd.Key)
+	return h.wrapped.Touch(cmd)
+}
+
+func (h *Handler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	defer h.written(cmd.Key)
+	return h.wrapped.Incr(cmd)
+}
+
+func (h *Handler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	defer h.written(cmd.Key)
+	return h.wrapped.Decr(cmd)
+}
+
+func (h *Handler) Close() error {
+	return h.wrapped.Close()
+}
@@ -0,0 +1,111 @@
+package coalesce
+
+import (
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// backend answers getEs with a fixed TTL and counts them.
+type backend struct {
+	handlers.Handler
+	getEs int
+}
+
+func (b *backend) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	b.getEs++
+	data := make(chan common.GetEResponse, len(cmd.Keys))
+	errors := make(chan error)
+	for idx, key := range cmd.Keys {
+		data <- common.GetEResponse{Key: key, Opaque: cmd.Opaques[idx], Data: []byte("backend"), Exptime: 60}
+	}
+	close(data)
+	close(errors)
+	return data, errors
+}
+
+func (b *backend) Set(cmd common.SetRequest) error { return nil }
+
+func getE(t *testing.T, h handlers.Handler, opaque uint32) common.GetEResponse {
+	data, errors := h.GetE(common.GetRequest{
+		Keys:    [][]byte{[]byte("key")},
+		Opaques: []uint32{opaque},
+		Quiet:   []bool{false},
+	})
+	var got []common.GetEResponse
+	for res := range data {
+		got = append(got, res)
+	}
+	for err := range errors {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d responses, want 1", len(got))
+	}
+	return got[0]
+}
+
+func TestGetEJoinsFetchInFlight(t *testing.T) {
+	b := &backend{}
+	h, err := New(func() (handlers.Handler, error) { return b, nil })()
+	if err != nil {
+		t.Fatal(err)
+	}
+	getEs := h.(*Handler).getEs
+
+	// Another getE of the key fetched it, and is still to land
+	f, _ := getEs.join(flightKey{key: "key"})
+	f.res = common.GetEResponse{Key: []byte("key"), Opaque: 3, Data: []byte("shared"), Exptime: 30}
+	f.answered = true
+	close(f.done)
+
+	res := getE(t, h, 7)
+	getEs.forget(flightKey{key: "key"}, f)
+	if string(res.Data) != "shared" || res.Exptime != 30 || res.Opaque != 7 {
+		t.Errorf("got %q with TTL %d and opaque %d, want the shared fetch relabeled", res.Data, res.Exptime, res.Opaque)
+	}
+	if b.getEs != 0 {
+		t.Errorf("backend got %d getEs, want none", b.getEs)
+	}
+
+	// A write makes later getEs fetch again rather than join
+	getEs.join(flightKey{key: "key"})
+	if err := h.Set(common.SetRequest{Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	if res := getE(t, h, 8); string(res.Data) != "backend" || b.getEs != 1 {
+		t.Errorf("got %q after %d backend getEs, want a fetch after the write", res.Data, b.getEs)
+	}
+}
+
+func TestGetEFailsAsAWholeWhenAJoinedFetchFails(t *testing.T) {
+	b := &backend{}
+	h, err := New(func() (handlers.Handler, error) { return b, nil })()
+	if err != nil {
+		t.Fatal(err)
+	}
+	getEs := h.(*Handler).getEs
+
+	// Another getE of the key fetched it and failed
+	f, _ := getEs.join(flightKey{key: "key"})
+	f.err = common.ErrTempFailure
+	close(f.done)
+
+	data, errors := h.GetE(common.GetRequest{
+		Keys:    [][]byte{[]byte("other"), []byte("key")},
+		Opaques: []uint32{1, 2},
+		Quiet:   []bool{false, false},
+	})
+	getEs.forget(flightKey{key: "key"}, f)
+	for res := range data {
+		t.Errorf("got a response for %q along with the failure", res.Key)
+	}
+	var got error
+	for err := range errors {
+		got = err
+	}
+	if got != common.ErrTempFailure {
+		t.Errorf("got error %v, want %v", got, common.ErrTempFailure)
+	}
+}
@@ -1,14 +1,92 @@
 package consulmemcached
 
 import (
+	"net"
+	"strings"
+
+	"github.com/BarthV/epoxy/breaker"
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/netflix/rend/common"
 )
 
+// newItem builds the gomemcache item carrying everything a write command
+// has to forward to the backend: key, data, flags, expiration and the CAS
+// unique of conditional writes.
+func newItem(cmd common.SetRequest) *memcache.Item {
+	return &memcache.Item{
+		Key:        string(cmd.Key),
+		Value:      cmd.Data,
+		Flags:      cmd.Flags,
+		Expiration: int32(cmd.Exptime),
+		CasID:      cmd.Cas,
+	}
+}
+
+// failedKeys returns whether a key could not be fetched by a get failing
+// with err.
+func failedKeys(err error) func(key string) bool {
+	switch e := err.(type) {
+	case nil:
+		return func(string) bool { return false }
+	case *memcache.KeysError:
+		failed := make(map[string]bool, len(e.Keys))
+		for _, key := range e.Keys {
+			failed[key] = true
+		}
+		return func(key string) bool { return failed[key] }
+	default:
+		return func(string) bool { return true }
+	}
+}
+
+// gomemcacheErrorMapper translates gomemcache errors into the rend errors
+// the text and binary responders know how to answer. Failures to reach a
+// backend are reported as temporary, anything else memcached did not
+// explicitly answer is reported as an internal error so that a sick backend
+// never tears down client connections.
 func gomemcacheErrorMapper(err error) error {
+	if ke, ok := err.(*memcache.KeysError); ok {
+		err = ke.Err
+	}
+
 	switch err {
+	case nil:
+		return nil
 	case memcache.ErrNoServers:
 		return common.ErrInternal
+	case memcache.ErrCacheMiss:
+		return common.ErrKeyNotFound
+	case memcache.ErrNotStored:
+		return common.ErrItemNotStored
+	case memcache.ErrCASConflict:
+		return common.ErrKeyExists
+	case memcache.ErrMalformedKey:
+		return common.ErrInvalidArgs
+	case memcache.ErrServerError:
+		return common.ErrInternal
+	case breaker.ErrOpen:
+		return common.ErrTempFailure
+	}
+
+	switch e := err.(type) {
+	case *memcache.ConnectTimeoutError:
+		return common.ErrTempFailure
+	case net.Error:
+		return common.ErrTempFailure
+	default:
+		// gomemcache reports server and client error replies as plain
+		// errors quoting the reply line
+		msg := e.Error()
+		switch {
+		case strings.Contains(msg, "non-numeric value"):
+			return common.ErrBadIncDecValue
+		case strings.Contains(msg, "out of memory"):
+			return common.ErrNoMem
+		case strings.Contains(msg, "too large"):
+			return common.ErrValueTooBig
+		case strings.Contains(msg, "CLIENT_ERROR"), strings.Contains(msg, "client error"):
+			return common.ErrInvalidArgs
+		}
 	}
-	return err
+	return common.ErrInternal
 }
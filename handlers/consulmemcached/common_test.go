@@ -0,0 +1,104 @@
+package consulmemcached
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/BarthV/epoxy/breaker"
+	"github.com/BarthV/epoxy/handlers/multiget"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/netflix/rend/common"
+)
+
+// timeoutError is a net.Error timing out, as deadlines on backend
+// connections do.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestGomemcacheErrorMapper(t *testing.T) {
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:11211")
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"nil", nil, nil},
+		{"no servers", memcache.ErrNoServers, common.ErrInternal},
+		{"cache miss", memcache.ErrCacheMiss, common.ErrKeyNotFound},
+		{"not stored", memcache.ErrNotStored, common.ErrItemNotStored},
+		{"cas conflict", memcache.ErrCASConflict, common.ErrKeyExists},
+		{"malformed key", memcache.ErrMalformedKey, common.ErrInvalidArgs},
+		{"server error", memcache.ErrServerError, common.ErrInternal},
+		{"connect timeout", &memcache.ConnectTimeoutError{Addr: addr}, common.ErrTempFailure},
+		{"net timeout", &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, common.ErrTempFailure},
+		{"circuit open", breaker.ErrOpen, common.ErrTempFailure},
+		{"failed keys", &memcache.KeysError{Keys: []string{"key"}, Err: breaker.ErrOpen}, common.ErrTempFailure},
+		{
+			"client error reply",
+			errors.New(`memcache: unexpected response line from "set": "CLIENT_ERROR bad data chunk\r\n"`),
+			common.ErrInvalidArgs,
+		},
+		{
+			"non-numeric incr",
+			errors.New("memcache: client error: cannot increment or decrement non-numeric value"),
+			common.ErrBadIncDecValue,
+		},
+		{
+			"server error reply",
+			errors.New(`memcache: unexpected response line from "set": "SERVER_ERROR busy\r\n"`),
+			common.ErrInternal,
+		},
+		{
+			"out of memory reply",
+			errors.New(`memcache: unexpected response line from "set": "SERVER_ERROR out of memory storing object\r\n"`),
+			common.ErrNoMem,
+		},
+		{
+			"too large reply",
+			errors.New(`memcache: unexpected response line from "set": "SERVER_ERROR object too large for cache\r\n"`),
+			common.ErrValueTooBig,
+		},
+	}
+
+	for _, test := range tests {
+		if got := gomemcacheErrorMapper(test.err); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestOpenCircuitFailsTemporarily(t *testing.T) {
+	fake := newFakeMemcached(t, func([]string) string { return "STORED\r\n" })
+	mc := memcache.New(fake.addr())
+	mc.Allow = func(net.Addr) error { return breaker.ErrOpen }
+	h, err := New(mc, multiget.FailClosed)()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Set(common.SetRequest{Key: []byte("key"), Data: []byte("value")}); err != common.ErrTempFailure {
+		t.Errorf("set: got %v, want %v", err, common.ErrTempFailure)
+	}
+	data, errors := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte("key")},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	for res := range data {
+		t.Errorf("get: got a response for %q", res.Key)
+	}
+	var got error
+	for err := range errors {
+		got = err
+	}
+	if got != common.ErrTempFailure {
+		t.Errorf("get: got %v, want %v", got, common.ErrTempFailure)
+	}
+	if lines := fake.received(); len(lines) != 0 {
+		t.Errorf("server got %q through an open circuit", lines)
+	}
+}
@@ -5,20 +5,25 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 
+	"github.com/BarthV/epoxy/handlers/multiget"
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/handlers"
 )
 
 type Handler struct {
-	mc *memcache.Client
+	mc   *memcache.Client
+	mode multiget.Mode
 }
 
-func New(mclient *memcache.Client) handlers.HandlerConst {
+// New returns the constructor of handlers proxying requests to mclient.
+// Keys whose server failed are answered according to mode.
+func New(mclient *memcache.Client, mode multiget.Mode) handlers.HandlerConst {
 	return func() (handlers.Handler, error) {
 		log.Info("New connexion")
 		handler := &Handler{
-			mc: mclient,
+			mc:   mclient,
+			mode: mode,
 		}
 		return handler, nil
 	}
@@ -26,52 +31,99 @@ func New(mclient *memcache.Client) handlers.HandlerConst {
 
 func (h *Handler) Set(cmd common.SetRequest) error {
 	log.WithFields(log.Fields{
-		"key":  cmd.Key,
-		"data": cmd.Data,
-		"ttl":  strconv.FormatInt(int64(cmd.Exptime), 10),
+		"key":   cmd.Key,
+		"data":  cmd.Data,
+		"flags": cmd.Flags,
+		"ttl":   strconv.FormatInt(int64(cmd.Exptime), 10),
 	}).Debug("Set operation")
 
-	err := h.mc.Set(&memcache.Item{Key: string(cmd.Key), Value: cmd.Data})
-	if err != nil {
-		return gomemcacheErrorMapper(err)
+	if cmd.Cas != 0 {
+		return h.cas(cmd)
 	}
-	return nil
+
+	err := h.mc.Set(newItem(cmd))
+	return gomemcacheErrorMapper(err)
 }
 
 func (h *Handler) Add(cmd common.SetRequest) error {
-	return nil
+	log.WithField("key", string(cmd.Key)).Debug("Add operation")
+
+	err := h.mc.Add(newItem(cmd))
+	if err == memcache.ErrNotStored {
+		return common.ErrKeyExists
+	}
+	return gomemcacheErrorMapper(err)
 }
 
 func (h *Handler) Replace(cmd common.SetRequest) error {
-	return nil
+	log.WithField("key", string(cmd.Key)).Debug("Replace operation")
+
+	if cmd.Cas != 0 {
+		return h.cas(cmd)
+	}
+
+	err := h.mc.Replace(newItem(cmd))
+	if err == memcache.ErrNotStored {
+		return common.ErrKeyNotFound
+	}
+	return gomemcacheErrorMapper(err)
+}
+
+// cas stores cmd only if the item on the backend still has the CAS unique
+// the client got from a previous gets.
+func (h *Handler) cas(cmd common.SetRequest) error {
+	log.WithFields(log.Fields{
+		"key": string(cmd.Key),
+		"cas": cmd.Cas,
+	}).Debug("CAS operation")
+
+	err := h.mc.CompareAndSwap(newItem(cmd))
+	if err == memcache.ErrNotStored {
+		return common.ErrKeyNotFound
+	}
+	return gomemcacheErrorMapper(err)
 }
 
 func (h *Handler) Append(cmd common.SetRequest) error {
-	return nil
+	log.WithField("key", string(cmd.Key)).Debug("Append operation")
+
+	err := h.mc.Append(newItem(cmd))
+	return gomemcacheErrorMapper(err)
 }
 
 func (h *Handler) Prepend(cmd common.SetRequest) error {
-	return nil
+	log.WithField("key", string(cmd.Key)).Debug("Prepend operation")
+
+	err := h.mc.Prepend(newItem(cmd))
+	return gomemcacheErrorMapper(err)
 }
 
 func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
-	dataOut := make(chan common.GetResponse, len(cmd.Keys))
-	defer close(dataOut)
-	errorOut := make(chan error)
-	defer close(errorOut)
+	keys := make([]string, len(cmd.Keys))
+	for idx, bk := range cmd.Keys {
+		keys[idx] = string(bk)
+	}
 
-	log.Debug("Get operation")
+	log.WithField("keys", keys).Debug("Get operation")
 
+	// GetMulti groups the keys by owning server and sends a single batched
+	// get to each of them in parallel. Items found on healthy servers are
+	// still returned when another server fails, along with the keys of the
+	// failed one.
+	items, err := h.mc.GetMulti(keys)
+	if err != nil {
+		log.WithError(err).Warn("Get fail")
+	}
+
+	res := multiget.NewResult[common.GetResponse](cmd)
+	res.Err = gomemcacheErrorMapper(err)
+	failed := failedKeys(err)
 	for idx, bk := range cmd.Keys {
-		item, err := h.mc.Get(string(bk))
-
-		if err != nil {
-			log.WithError(err).Debug("Get fail")
-			dataOut <- common.GetResponse{
-				Miss:   true,
-				Quiet:  cmd.Quiet[idx],
-				Opaque: cmd.Opaques[idx],
-				Key:    bk,
+		item, ok := items[keys[idx]]
+		if !ok {
+			if !failed(keys[idx]) {
+				res.Responses[idx] = multiget.Miss[common.GetResponse](cmd, idx)
+				res.Answered[idx] = true
 			}
 			continue
 		}
@@ -80,34 +132,164 @@ func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan
 			"key":  item.Key,
 			"data": item.Value,
 			"ttl":  strconv.FormatInt(int64(item.Expiration), 10),
-		}).Debug("Get operation")
+		}).Debug("Get hit")
 
-		dataOut <- common.GetResponse{
+		var cas uint64
+		if cmd.Cas {
+			cas = item.CasID
+		}
+
+		res.Responses[idx] = common.GetResponse{
 			Miss:   false,
 			Quiet:  cmd.Quiet[idx],
 			Opaque: cmd.Opaques[idx],
 			Flags:  item.Flags,
+			Cas:    cas,
 			Key:    bk,
 			Data:   item.Value,
 		}
+		res.Answered[idx] = true
 	}
-	return dataOut, errorOut
+	return multiget.Reply(cmd, res, h.mode)
 }
 
 func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
-	return nil, nil
+	keys := make([]string, len(cmd.Keys))
+	for idx, bk := range cmd.Keys {
+		keys[idx] = string(bk)
+	}
+
+	log.WithField("keys", keys).Debug("GetE operation")
+
+	// Remaining TTLs come from the backend itself through meta gets. They
+	// are unknown on memcached older than 1.6, and answered as no TTL.
+	items, err := h.mc.GetMultiTTL(keys)
+	if err != nil {
+		log.WithError(err).Warn("GetE fail")
+	}
+
+	res := multiget.NewResult[common.GetEResponse](cmd)
+	res.Err = gomemcacheErrorMapper(err)
+	failed := failedKeys(err)
+	for idx, bk := range cmd.Keys {
+		item, ok := items[keys[idx]]
+		if !ok {
+			if !failed(keys[idx]) {
+				res.Responses[idx] = multiget.Miss[common.GetEResponse](cmd, idx)
+				res.Answered[idx] = true
+			}
+			continue
+		}
+
+		// memcached reports items without expiration with a -1 TTL
+		var exptime uint32
+		if item.Expiration > 0 {
+			exptime = uint32(item.Expiration)
+		}
+
+		res.Responses[idx] = common.GetEResponse{
+			Miss:    false,
+			Quiet:   cmd.Quiet[idx],
+			Opaque:  cmd.Opaques[idx],
+			Flags:   item.Flags,
+			Exptime: exptime,
+			Key:     bk,
+			Data:    item.Value,
+		}
+		res.Answered[idx] = true
+	}
+	return multiget.Reply(cmd, res, h.mode)
 }
 
 func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
-	return common.GetResponse{}, nil
+	log.WithFields(log.Fields{
+		"key": string(cmd.Key),
+		"ttl": strconv.FormatInt(int64(cmd.Exptime), 10),
+	}).Debug("GAT operation")
+
+	miss := common.GetResponse{
+		Miss:   true,
+		Quiet:  cmd.Quiet,
+		Opaque: cmd.Opaque,
+		Key:    cmd.Key,
+	}
+
+	// gomemcache has no get-and-touch command, and memcached only has gat
+	// since 1.5.3, so the item is read first and touched afterwards. An
+	// item evicted in between is answered as a miss.
+	item, err := h.mc.Get(string(cmd.Key))
+	if err == memcache.ErrCacheMiss {
+		return miss, nil
+	} else if err != nil {
+		return common.GetResponse{}, gomemcacheErrorMapper(err)
+	}
+
+	err = h.mc.Touch(string(cmd.Key), int32(cmd.Exptime))
+	if err == memcache.ErrCacheMiss {
+		return miss, nil
+	} else if err != nil {
+		return common.GetResponse{}, gomemcacheErrorMapper(err)
+	}
+
+	return common.GetResponse{
+		Miss:   false,
+		Quiet:  cmd.Quiet,
+		Opaque: cmd.Opaque,
+		Flags:  item.Flags,
+		Cas:    item.CasID,
+		Key:    cmd.Key,
+		Data:   item.Value,
+	}, nil
 }
 
 func (h *Handler) Delete(cmd common.DeleteRequest) error {
-	return nil
+	log.WithField("key", string(cmd.Key)).Debug("Delete operation")
+
+	return gomemcacheErrorMapper(h.mc.Delete(string(cmd.Key)))
 }
 
 func (h *Handler) Touch(cmd common.TouchRequest) error {
-	return nil
+	log.WithFields(log.Fields{
+		"key": string(cmd.Key),
+		"ttl": strconv.FormatInt(int64(cmd.Exptime), 10),
+	}).Debug("Touch operation")
+
+	return gomemcacheErrorMapper(h.mc.Touch(string(cmd.Key), int32(cmd.Exptime)))
+}
+
+func (h *Handler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.incrDecr(cmd, h.mc.Increment)
+}
+
+func (h *Handler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.incrDecr(cmd, h.mc.Decrement)
+}
+
+// incrDecr applies op on the key owner, creating a missing counter with its
+// initial value when the request allows it, as memcached binary protocol
+// does.
+func (h *Handler) incrDecr(cmd common.IncrDecrRequest, op func(string, uint64) (uint64, error)) (uint64, error) {
+	log.WithFields(log.Fields{
+		"key":   string(cmd.Key),
+		"delta": cmd.Delta,
+	}).Debug("Incr/Decr operation")
+
+	val, err := op(string(cmd.Key), cmd.Delta)
+	if err != memcache.ErrCacheMiss || cmd.Exptime == common.IncrDecrNoCreate {
+		return val, gomemcacheErrorMapper(err)
+	}
+
+	err = h.mc.Add(&memcache.Item{
+		Key:        string(cmd.Key),
+		Value:      []byte(strconv.FormatUint(cmd.Initial, 10)),
+		Expiration: int32(cmd.Exptime),
+	})
+	if err == memcache.ErrNotStored {
+		// Created concurrently, apply the operation on that one
+		val, err = op(string(cmd.Key), cmd.Delta)
+		return val, gomemcacheErrorMapper(err)
+	}
+	return cmd.Initial, gomemcacheErrorMapper(err)
 }
 
 func (h *Handler) Close() error {
@@ -0,0 +1,236 @@
+package consulmemcached
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/BarthV/epoxy/handlers/multiget"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/netflix/rend/common"
+)
+
+// fakeMemcached is a memcached server speaking just enough of the text
+// protocol for tests. It records the command lines it receives and answers
+// them with reply.
+type fakeMemcached struct {
+	ln    net.Listener
+	reply func(fields []string) string
+
+	mu    sync.Mutex
+	lines []string
+}
+
+func newFakeMemcached(t *testing.T, reply func(fields []string) string) *fakeMemcached {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeMemcached{ln: ln, reply: reply}
+	go f.serve()
+	t.Cleanup(func() { ln.Close() })
+	return f
+}
+
+func (f *fakeMemcached) addr() string {
+	return f.ln.Addr().String()
+}
+
+func (f *fakeMemcached) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.lines...)
+}
+
+func (f *fakeMemcached) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeMemcached) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "set", "add", "replace", "append", "prepend", "cas":
+			// The data block follows the command line
+			size, err := strconv.Atoi(fields[4])
+			if err != nil {
+				return
+			}
+			if _, err := io.CopyN(io.Discard, r, int64(size)+2); err != nil {
+				return
+			}
+		}
+
+		f.mu.Lock()
+		f.lines = append(f.lines, line)
+		f.mu.Unlock()
+
+		if _, err := io.WriteString(conn, f.reply(fields)); err != nil {
+			return
+		}
+	}
+}
+
+func TestWritesPassFlagsAndExptime(t *testing.T) {
+	fake := newFakeMemcached(t, func([]string) string { return "STORED\r\n" })
+	handler, err := New(memcache.New(fake.addr()), multiget.FailClosed)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := handler.(*Handler)
+
+	cmd := common.SetRequest{
+		Key:     []byte("key"),
+		Data:    []byte("value"),
+		Flags:   42,
+		Exptime: 300,
+	}
+	tests := []struct {
+		op   func(common.SetRequest) error
+		cas  uint64
+		want string
+	}{
+		{h.Set, 0, "set key 42 300 5"},
+		{h.Add, 0, "add key 42 300 5"},
+		{h.Replace, 0, "replace key 42 300 5"},
+		{h.Append, 0, "append key 42 300 5"},
+		{h.Prepend, 0, "prepend key 42 300 5"},
+		{h.Set, 7, "cas key 42 300 5 7"},
+	}
+	for _, test := range tests {
+		cmd.Cas = test.cas
+		if err := test.op(cmd); err != nil {
+			t.Errorf("%s: %v", test.want, err)
+		}
+	}
+
+	lines := fake.received()
+	if len(lines) != len(tests) {
+		t.Fatalf("got %d commands, want %d: %q", len(lines), len(tests), lines)
+	}
+	for i, test := range tests {
+		if lines[i] != test.want {
+			t.Errorf("got %q, want %q", lines[i], test.want)
+		}
+	}
+}
+
+func TestGetEWithoutMetaCommands(t *testing.T) {
+	fake := newFakeMemcached(t, func(fields []string) string {
+		switch fields[0] {
+		case "gets":
+			return "VALUE key 42 5 9\r\nvalue\r\nEND\r\n"
+		default:
+			// memcached before 1.6 knows no meta commands
+			return "ERROR\r\n"
+		}
+	})
+	handler, err := New(memcache.New(fake.addr()), multiget.FailClosed)()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := common.GetRequest{
+		Keys:    [][]byte{[]byte("key")},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	}
+	for i := 0; i < 2; i++ {
+		data, errors := handler.GetE(cmd)
+		var responses []common.GetEResponse
+		for res := range data {
+			responses = append(responses, res)
+		}
+		for err := range errors {
+			t.Fatal(err)
+		}
+		if len(responses) != 1 {
+			t.Fatalf("got %d responses, want 1", len(responses))
+		}
+		res := responses[0]
+		if res.Miss || string(res.Data) != "value" || res.Flags != 42 || res.Exptime != 0 {
+			t.Errorf("got %+v, want a hit on value with flags 42 and no TTL", res)
+		}
+	}
+
+	// Meta gets are tried once, plain gets are sent from then on
+	var metaGets, gets int
+	for _, line := range fake.received() {
+		switch strings.Fields(line)[0] {
+		case "mg":
+			metaGets++
+		case "gets":
+			gets++
+		}
+	}
+	if metaGets != 1 || gets != 2 {
+		t.Errorf("got %d meta gets and %d gets, want 1 and 2", metaGets, gets)
+	}
+}
+
+func TestGetFailsKeysOfFailedServers(t *testing.T) {
+	fake := newFakeMemcached(t, func([]string) string { return "END\r\n" })
+	// Nothing listens on the second server
+	servers := new(memcache.ServerList)
+	if err := servers.SetServers(fake.addr(), "127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	handler, err := New(memcache.NewFromSelector(servers), multiget.FailKeys)()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := common.GetRequest{}
+	down := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		key := "key:" + strconv.Itoa(i)
+		cmd.Keys = append(cmd.Keys, []byte(key))
+		cmd.Opaques = append(cmd.Opaques, 0)
+		cmd.Quiet = append(cmd.Quiet, false)
+		addr, err := servers.PickServer(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		down[key] = addr.String() != fake.addr()
+	}
+
+	data, errors := handler.Get(cmd)
+	answered := map[string]bool{}
+	for res := range data {
+		if !res.Miss {
+			t.Errorf("got a hit on %s", res.Key)
+		}
+		answered[string(res.Key)] = true
+	}
+	for err := range errors {
+		if err != common.ErrTempFailure {
+			t.Errorf("got error %v, want %v", err, common.ErrTempFailure)
+		}
+	}
+	for key, failed := range down {
+		if answered[key] == failed {
+			t.Errorf("%s: got answered %v, want %v", key, answered[key], !failed)
+		}
+	}
+}
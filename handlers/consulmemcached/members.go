@@ -0,0 +1,28 @@
+package consulmemcached
+
+import (
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/BarthV/epoxy/discovery"
+	"github.com/BarthV/epoxy/selector"
+)
+
+// UpdateServers applies to list every cluster membership received on
+// updates. Servers are ordered by identity first, so that an update only
+// reordering servers leaves key placement alone.
+func UpdateServers(list selector.Selector, updates <-chan []discovery.Member) {
+	for members := range updates {
+		discovery.SortByID(members)
+		cluster := make([]selector.Server, len(members))
+		for i, m := range members {
+			cluster[i] = selector.Server{Address: m.Address, Weight: m.Weight}
+		}
+		if err := list.SetServers(cluster...); err != nil {
+			log.WithError(err).Error("Memcached client serverlist update failed")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"cluster": cluster,
+		}).Info("Cluster update")
+	}
+}
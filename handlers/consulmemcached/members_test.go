@@ -0,0 +1,61 @@
+package consulmemcached
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/BarthV/epoxy/discovery"
+	"github.com/BarthV/epoxy/selector"
+)
+
+// placement returns the server of each of a thousand keys once members
+// have been applied to s.
+func placement(t *testing.T, s selector.Selector, members []discovery.Member) []string {
+	updates := make(chan []discovery.Member, 1)
+	updates <- append([]discovery.Member(nil), members...)
+	close(updates)
+	UpdateServers(s, updates)
+
+	servers := make([]string, 1000)
+	for i := range servers {
+		addr, err := s.PickServer(fmt.Sprintf("key:%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[i] = addr.String()
+	}
+	return servers
+}
+
+func TestReorderedMembershipKeepsPlacement(t *testing.T) {
+	members := []discovery.Member{
+		{ID: "node-a/memcached", Address: "10.0.0.1:11211"},
+		{ID: "node-b/memcached", Address: "10.0.0.2:11211", Weight: 2},
+		{ID: "node-c/memcached", Address: "10.0.0.3:11211"},
+		{ID: "node-d/memcached", Address: "10.0.0.4:11211"},
+	}
+	reordered := []discovery.Member{members[2], members[0], members[3], members[1]}
+
+	hash, err := selector.ParseHash("crc32a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selectors := map[string]func() selector.Selector{
+		"modula": func() selector.Selector { return selector.NewModula(hash) },
+		"ketama": func() selector.Selector { return selector.NewKetama(hash) },
+	}
+	for name, newSelector := range selectors {
+		s := newSelector()
+		before := placement(t, s, members)
+		after := placement(t, s, reordered)
+		moved := 0
+		for i := range before {
+			if before[i] != after[i] {
+				moved++
+			}
+		}
+		if moved != 0 {
+			t.Errorf("%s: %d keys out of %d moved", name, moved, len(before))
+		}
+	}
+}
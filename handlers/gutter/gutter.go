@@ -0,0 +1,274 @@
+// Package gutter provides a handler falling back to a gutter pool when the
+// server owning a key is down, as described in "Scaling Memcache at
+// Facebook". Items stored in the gutter pool expire quickly, so that it
+// absorbs the load a dead server would otherwise send to databases without
+// serving stale data for long. Writes the primary pool answers drop the
+// gutter copy of their key, for later failovers not to serve it.
+package gutter
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/BarthV/epoxy/handlers/multiget"
+	"github.com/BarthV/epoxy/hedge"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+type Handler struct {
+	primary handlers.Handler
+	gutter  handlers.Handler
+	ttl     uint32
+	mode    multiget.Mode
+	hedge   *hedge.Delay
+	metrics *gutterMetrics
+}
+
+type gutterMetrics struct {
+	reads    uint32
+	writes   uint32
+	failures uint32
+}
+
+// New returns the constructor of handlers sending requests to the gutter
+// pool when the primary pool fails to answer them. The primary handlers
+// must report backend failures as errors, with multiget.FailKeys for gets.
+// Writes to the gutter pool expire after ttl at most, a second or more.
+// Keys the gutter pool fails to fetch too are answered according to mode.
+// Gets slower than the hedge delay are sent to the gutter pool too, its
+// hits answering them, unless hedge is nil.
+func New(primary, gutter handlers.HandlerConst, ttl time.Duration, mode multiget.Mode, hedge *hedge.Delay, tags metrics.Tags) handlers.HandlerConst {
+	m := &gutterMetrics{
+		reads:    metrics.AddCounter("gutter_reads", tags),
+		writes:   metrics.AddCounter("gutter_writes", tags),
+		failures: metrics.AddCounter("gutter_failures", tags),
+	}
+	return func() (handlers.Handler, error) {
+		p, err := primary()
+		if err != nil {
+			return nil, err
+		}
+		g, err := gutter()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		return &Handler{
+			primary: p,
+			gutter:  g,
+			ttl:     uint32(ttl / time.Second),
+			mode:    mode,
+			hedge:   hedge,
+			metrics: m,
+		}, nil
+	}
+}
+
+// errGutterMiss tells a get of the gutter pool missed keys the primary pool
+// may hold, so that it only answers once the primary is down.
+var errGutterMiss = errors.New("gutter: miss")
+
+// answer returns the error of a get of the gutter pool as a hedge attempt,
+// nil when it hit every key.
+func answer[R multiget.Response](res *multiget.Result[R]) error {
+	if err := res.Failure(); err != nil {
+		return err
+	}
+	for _, r := range res.Responses {
+		if multiget.Missed(r) {
+			return errGutterMiss
+		}
+	}
+	return nil
+}
+
+// capped returns exptime, shortened to the gutter TTL. Unix timestamps
+// count as later than the TTL.
+func (h *Handler) capped(exptime uint32) uint32 {
+	if exptime == 0 || exptime > h.ttl {
+		return h.ttl
+	}
+	return exptime
+}
+
+// invalidate drops in the background the gutter copy of a key the primary
+// pool answered a write of, which a later failover would otherwise serve
+// until it expires.
+func (h *Handler) invalidate(key []byte) {
+	go func() {
+		err := h.gutter.Delete(common.DeleteRequest{Key: key})
+		if err != nil && err != common.ErrKeyNotFound {
+			log.WithError(err).WithField("key", string(key)).Debug("Gutter invalidation fail")
+		}
+	}()
+}
+
+// write applies op on the primary pool, or on the gutter pool with a
+// capped expiration when the primary is down.
+func (h *Handler) write(cmd common.SetRequest, op func(handlers.Handler, common.SetRequest) error) error {
+	err := op(h.primary, cmd)
+	if !multiget.Failed(err) {
+		h.invalidate(cmd.Key)
+		return err
+	}
+
+	metrics.IncCounter(h.metrics.writes)
+	log.WithError(err).WithField("key", string(cmd.Key)).Debug("Primary down, writing to gutter")
+	cmd.Exptime = h.capped(cmd.Exptime)
+	return op(h.gutter, cmd)
+}
+
+func (h *Handler) Set(cmd common.SetRequest) error {
+	return h.write(cmd, handlers.Handler.Set)
+}
+
+func (h *Handler) Add(cmd common.SetRequest) error {
+	return h.write(cmd, handlers.Handler.Add)
+}
+
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	return h.write(cmd, handlers.Handler.Replace)
+}
+
+func (h *Handler) Append(cmd common.SetRequest) error {
+	return h.write(cmd, handlers.Handler.Append)
+}
+
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	return h.write(cmd, handlers.Handler.Prepend)
+}
+
+// Get reads from the gutter pool the keys whose server of the primary pool
+// is down, or all of them when the primary pool is slow while the gutter
+// pool holds them all.
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	return read(h, cmd, handlers.Handler.Get)
+}
+
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	return read(h, cmd, handlers.Handler.GetE)
+}
+
+// read gets the keys of cmd with get from the primary pool, or else from
+// the gutter pool.
+func read[R multiget.Response](h *Handler, cmd common.GetRequest, get func(handlers.Handler, common.GetRequest) (<-chan R, <-chan error)) (<-chan R, <-chan error) {
+	var primary, gutter *multiget.Result[R]
+	var positions []int
+	var hedged bool
+	primaryDone := make(chan struct{})
+
+	chosen, _ := h.hedge.Race(
+		func() error {
+			data, errors := get(h.primary, cmd)
+			primary = multiget.Read(cmd, data, errors)
+			close(primaryDone)
+			return primary.Failure()
+		},
+		func() error {
+			metrics.IncCounter(h.metrics.reads)
+			sub := cmd
+			select {
+			case <-primaryDone:
+				// Only the keys of the failed primary servers
+				positions = primary.Missing()
+				sub = multiget.Subset(cmd, positions)
+			default:
+				// Hedging a slow primary
+				hedged = true
+				positions = make([]int, len(cmd.Keys))
+				for i := range positions {
+					positions[i] = i
+				}
+			}
+			log.WithField("keys", len(sub.Keys)).Debug("Reading from gutter")
+			data, errors := get(h.gutter, sub)
+			gutter = multiget.Read(sub, data, errors)
+			return answer(gutter)
+		},
+	)
+
+	switch {
+	case chosen == 0:
+		return multiget.Reply(cmd, primary, multiget.FailClosed)
+	case chosen == 1 && hedged:
+		return multiget.Reply(cmd, gutter, multiget.FailClosed)
+	}
+
+	// The primary failed, the keys of its failed servers are answered by
+	// the gutter pool, misses included
+	merged := multiget.NewResult[R](cmd)
+	merged.Merge(primary)
+	merged.Fill(gutter, positions)
+	if !merged.Complete() {
+		metrics.IncCounter(h.metrics.failures)
+	}
+	return multiget.Reply(cmd, merged, h.mode)
+}
+
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	res, err := h.primary.GAT(cmd)
+	if !multiget.Failed(err) {
+		return res, err
+	}
+
+	metrics.IncCounter(h.metrics.reads)
+	cmd.Exptime = h.capped(cmd.Exptime)
+	return h.gutter.GAT(cmd)
+}
+
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	err := h.primary.Delete(cmd)
+	if !multiget.Failed(err) {
+		h.invalidate(cmd.Key)
+		return err
+	}
+
+	metrics.IncCounter(h.metrics.writes)
+	return h.gutter.Delete(cmd)
+}
+
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	err := h.primary.Touch(cmd)
+	if !multiget.Failed(err) {
+		h.invalidate(cmd.Key)
+		return err
+	}
+
+	metrics.IncCounter(h.metrics.writes)
+	cmd.Exptime = h.capped(cmd.Exptime)
+	return h.gutter.Touch(cmd)
+}
+
+func (h *Handler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.incrDecr(cmd, handlers.Handler.Incr)
+}
+
+func (h *Handler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.incrDecr(cmd, handlers.Handler.Decr)
+}
+
+func (h *Handler) incrDecr(cmd common.IncrDecrRequest, op func(handlers.Handler, common.IncrDecrRequest) (uint64, error)) (uint64, error) {
+	val, err := op(h.primary, cmd)
+	if !multiget.Failed(err) {
+		h.invalidate(cmd.Key)
+		return val, err
+	}
+
+	metrics.IncCounter(h.metrics.writes)
+	if cmd.Exptime != common.IncrDecrNoCreate {
+		cmd.Exptime = h.capped(cmd.Exptime)
+	}
+	return op(h.gutter, cmd)
+}
+
+func (h *Handler) Close() error {
+	err := h.primary.Close()
+	if gerr := h.gutter.Close(); gerr != nil {
+		err = gerr
+	}
+	return err
+}
@@ -0,0 +1,179 @@
+package gutter
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BarthV/epoxy/handlers/multiget"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// pool is a handler answering gets from values, failing the keys in down as
+// a multiget.FailKeys handler does. It records the keys it was asked for.
+type pool struct {
+	handlers.Handler
+	values map[string]string
+	down   map[string]bool
+
+	mu      sync.Mutex
+	asked   []string
+	deleted []string
+}
+
+func (p *pool) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	res := multiget.NewResult[common.GetResponse](cmd)
+	for idx, key := range cmd.Keys {
+		p.mu.Lock()
+		p.asked = append(p.asked, string(key))
+		p.mu.Unlock()
+		if p.down[string(key)] {
+			res.Err = common.ErrTempFailure
+			continue
+		}
+		res.Answered[idx] = true
+		value, ok := p.values[string(key)]
+		if !ok {
+			res.Responses[idx] = multiget.Miss[common.GetResponse](cmd, idx)
+			continue
+		}
+		res.Responses[idx] = common.GetResponse{Key: key, Opaque: cmd.Opaques[idx], Data: []byte(value)}
+	}
+	return multiget.Reply(cmd, res, multiget.FailKeys)
+}
+
+func (p *pool) Set(cmd common.SetRequest) error { return nil }
+
+func (p *pool) Delete(cmd common.DeleteRequest) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deleted = append(p.deleted, string(cmd.Key))
+	return nil
+}
+
+func (p *pool) Close() error { return nil }
+
+func constructor(p *pool) handlers.HandlerConst {
+	return func() (handlers.Handler, error) { return p, nil }
+}
+
+func request(keys ...string) common.GetRequest {
+	cmd := common.GetRequest{
+		Keys:    make([][]byte, len(keys)),
+		Opaques: make([]uint32, len(keys)),
+		Quiet:   make([]bool, len(keys)),
+	}
+	for i, key := range keys {
+		cmd.Keys[i] = []byte(key)
+	}
+	return cmd
+}
+
+func TestGetFallsBackKeyByKey(t *testing.T) {
+	primary := &pool{
+		values: map[string]string{"a": "primary"},
+		down:   map[string]bool{"b": true, "c": true},
+	}
+	gutter := &pool{
+		values: map[string]string{"a": "gutter", "b": "gutter"},
+		down:   map[string]bool{},
+	}
+	h, err := New(constructor(primary), constructor(gutter), 10*time.Second, multiget.FailClosed, nil, nil)()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, errors := h.Get(request("a", "b", "c", "d"))
+	var got []string
+	for res := range data {
+		if res.Miss {
+			got = append(got, string(res.Key)+":miss")
+		} else {
+			got = append(got, string(res.Key)+":"+string(res.Data))
+		}
+	}
+	for err := range errors {
+		t.Fatal(err)
+	}
+
+	want := []string{"a:primary", "b:gutter", "c:miss", "d:miss"}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %q, want %q", got, want)
+			break
+		}
+	}
+	if len(gutter.asked) != 2 || gutter.asked[0] != "b" || gutter.asked[1] != "c" {
+		t.Errorf("gutter asked for %q, want the keys of failed servers b and c", gutter.asked)
+	}
+}
+
+func TestGetFailsWhenGutterFailsToo(t *testing.T) {
+	primary := &pool{down: map[string]bool{"a": true}}
+	gutter := &pool{down: map[string]bool{"a": true}}
+	for _, mode := range []multiget.Mode{multiget.FailClosed, multiget.FailOpen} {
+		h, err := New(constructor(primary), constructor(gutter), 10*time.Second, mode, nil, nil)()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, errors := h.Get(request("a", "b"))
+		responses := 0
+		for range data {
+			responses++
+		}
+		var getErr error
+		for e := range errors {
+			getErr = e
+		}
+		switch mode {
+		case multiget.FailClosed:
+			if getErr != common.ErrTempFailure {
+				t.Errorf("fail closed: got error %v, want %v", getErr, common.ErrTempFailure)
+			}
+		case multiget.FailOpen:
+			if getErr != nil || responses != 2 {
+				t.Errorf("fail open: got %d responses and error %v, want 2 misses", responses, getErr)
+			}
+		}
+	}
+}
+
+func TestPrimaryWritesInvalidateGutter(t *testing.T) {
+	primary := &pool{}
+	gutter := &pool{}
+	h, err := New(constructor(primary), constructor(gutter), 10*time.Second, multiget.FailClosed, nil, nil)()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Set(common.SetRequest{Key: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Delete(common.DeleteRequest{Key: []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{"a": true, "b": true}
+	deadline := time.Now().Add(time.Second)
+	for {
+		gutter.mu.Lock()
+		got := make(map[string]bool)
+		for _, key := range gutter.deleted {
+			got[key] = true
+		}
+		gutter.mu.Unlock()
+		if reflect.DeepEqual(got, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("gutter deleted %v, want the keys written to the primary %v", got, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,389 @@
+// Package lru provides a handler caching items in process memory, meant to
+// be the L1 of rend's L1L2 orcas in front of memcached pools. Hot keys are
+// then served without any round trip. Items carry no CAS unique, gets
+// served from it answer without one. Items expire after a maximum TTL
+// whatever the one they were stored with, so that writes through other
+// proxies show up.
+package lru
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+const (
+	// entryOverhead approximates the memory used by an entry besides its
+	// key and data.
+	entryOverhead = 128
+
+	// maxRelativeExptime is the largest expiration memcached reads as a
+	// number of seconds, larger ones being unix timestamps.
+	maxRelativeExptime = 60 * 60 * 24 * 30
+)
+
+var (
+	MetricEvictions = metrics.AddCounter("lru_evictions", nil)
+	MetricExpired   = metrics.AddCounter("lru_expired", nil)
+	MetricBytes     = metrics.AddIntGauge("lru_bytes", nil)
+	MetricItems     = metrics.AddIntGauge("lru_items", nil)
+)
+
+// Cache is a least recently used cache of items, bounded by the memory they
+// use. It is safe for concurrent use and meant to be shared by every
+// handler.
+type Cache struct {
+	maxBytes int
+	maxTTL   time.Duration
+
+	mu    sync.Mutex
+	bytes int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type entry struct {
+	key     string
+	data    []byte
+	flags   uint32
+	expires time.Time
+}
+
+func (e *entry) size() int {
+	return len(e.key) + len(e.data) + entryOverhead
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !now.Before(e.expires)
+}
+
+// NewCache returns an empty cache holding at most maxBytes of items, for
+// maxTTL at most.
+func NewCache(maxBytes int, maxTTL time.Duration) *Cache {
+	return &Cache{
+		maxBytes: maxBytes,
+		maxTTL:   maxTTL,
+		ll:       list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+// expiry returns the time an item stored with exptime expires, the maximum
+// TTL from now at the latest.
+func (c *Cache) expiry(exptime uint32) time.Time {
+	now := time.Now()
+	latest := now.Add(c.maxTTL)
+	expires := latest
+	switch {
+	case exptime == 0:
+	case exptime > maxRelativeExptime:
+		expires = time.Unix(int64(exptime), 0)
+	default:
+		expires = now.Add(time.Duration(exptime) * time.Second)
+	}
+	if expires.After(latest) {
+		return latest
+	}
+	return expires
+}
+
+// get returns the live entry of key, marking it as recently used. c.mu
+// must be held.
+func (c *Cache) get(key []byte) (*entry, bool) {
+	elem, ok := c.items[string(key)]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*entry)
+	if e.expired(time.Now()) {
+		metrics.IncCounter(MetricExpired)
+		c.remove(elem)
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return e, true
+}
+
+// put stores e, evicting the least recently used entries to make room.
+// c.mu must be held.
+func (c *Cache) put(e *entry) {
+	if elem, ok := c.items[e.key]; ok {
+		c.remove(elem)
+	}
+	if e.size() > c.maxBytes {
+		return
+	}
+
+	c.items[e.key] = c.ll.PushFront(e)
+	c.bytes += e.size()
+	for c.bytes > c.maxBytes {
+		metrics.IncCounter(MetricEvictions)
+		c.remove(c.ll.Back())
+	}
+	c.report()
+}
+
+// remove drops elem. c.mu must be held.
+func (c *Cache) remove(elem *list.Element) {
+	e := c.ll.Remove(elem).(*entry)
+	delete(c.items, e.key)
+	c.bytes -= e.size()
+	c.report()
+}
+
+func (c *Cache) report() {
+	metrics.SetIntGauge(MetricBytes, uint64(c.bytes))
+	metrics.SetIntGauge(MetricItems, uint64(len(c.items)))
+}
+
+type Handler struct {
+	cache *Cache
+}
+
+// New returns the constructor of handlers serving requests from cache.
+func New(cache *Cache) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		return &Handler{cache: cache}, nil
+	}
+}
+
+func (c *Cache) newEntry(cmd common.SetRequest) *entry {
+	return &entry{
+		key:     string(cmd.Key),
+		data:    cmd.Data,
+		flags:   cmd.Flags,
+		expires: c.expiry(cmd.Exptime),
+	}
+}
+
+// Set stores the item. CAS uniques are not checked, the L2 already did.
+func (h *Handler) Set(cmd common.SetRequest) error {
+	h.cache.mu.Lock()
+	defer h.cache.mu.Unlock()
+
+	h.cache.put(h.cache.newEntry(cmd))
+	return nil
+}
+
+func (h *Handler) Add(cmd common.SetRequest) error {
+	h.cache.mu.Lock()
+	defer h.cache.mu.Unlock()
+
+	if _, ok := h.cache.get(cmd.Key); ok {
+		return common.ErrKeyExists
+	}
+	h.cache.put(h.cache.newEntry(cmd))
+	return nil
+}
+
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	h.cache.mu.Lock()
+	defer h.cache.mu.Unlock()
+
+	if _, ok := h.cache.get(cmd.Key); !ok {
+		return common.ErrKeyNotFound
+	}
+	h.cache.put(h.cache.newEntry(cmd))
+	return nil
+}
+
+func (h *Handler) Append(cmd common.SetRequest) error {
+	h.cache.mu.Lock()
+	defer h.cache.mu.Unlock()
+
+	e, ok := h.cache.get(cmd.Key)
+	if !ok {
+		return common.ErrKeyNotFound
+	}
+	data := make([]byte, 0, len(e.data)+len(cmd.Data))
+	data = append(append(data, e.data...), cmd.Data...)
+	h.cache.put(&entry{key: e.key, data: data, flags: e.flags, expires: e.expires})
+	return nil
+}
+
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	h.cache.mu.Lock()
+	defer h.cache.mu.Unlock()
+
+	e, ok := h.cache.get(cmd.Key)
+	if !ok {
+		return common.ErrKeyNotFound
+	}
+	data := make([]byte, 0, len(e.data)+len(cmd.Data))
+	data = append(append(data, cmd.Data...), e.data...)
+	h.cache.put(&entry{key: e.key, data: data, flags: e.flags, expires: e.expires})
+	return nil
+}
+
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	defer close(dataOut)
+	errorOut := make(chan error)
+	defer close(errorOut)
+
+	h.cache.mu.Lock()
+	defer h.cache.mu.Unlock()
+
+	for idx, key := range cmd.Keys {
+		e, ok := h.cache.get(key)
+		if !ok {
+			dataOut <- common.GetResponse{
+				Miss:   true,
+				Quiet:  cmd.Quiet[idx],
+				Opaque: cmd.Opaques[idx],
+				Key:    key,
+			}
+			continue
+		}
+		dataOut <- common.GetResponse{
+			Miss:   false,
+			Quiet:  cmd.Quiet[idx],
+			Opaque: cmd.Opaques[idx],
+			Flags:  e.flags,
+			Key:    key,
+			Data:   e.data,
+		}
+	}
+	return dataOut, errorOut
+}
+
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
+	defer close(dataOut)
+	errorOut := make(chan error)
+	defer close(errorOut)
+
+	h.cache.mu.Lock()
+	defer h.cache.mu.Unlock()
+
+	now := time.Now()
+	for idx, key := range cmd.Keys {
+		e, ok := h.cache.get(key)
+		if !ok {
+			dataOut <- common.GetEResponse{
+				Miss:   true,
+				Quiet:  cmd.Quiet[idx],
+				Opaque: cmd.Opaques[idx],
+				Key:    key,
+			}
+			continue
+		}
+
+		// Round up, an item about to expire still has a second left
+		exptime := uint32((e.expires.Sub(now) + time.Second - 1) / time.Second)
+		dataOut <- common.GetEResponse{
+			Miss:    false,
+			Quiet:   cmd.Quiet[idx],
+			Opaque:  cmd.Opaques[idx],
+			Flags:   e.flags,
+			Exptime: exptime,
+			Key:     key,
+			Data:    e.data,
+		}
+	}
+	return dataOut, errorOut
+}
+
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	h.cache.mu.Lock()
+	defer h.cache.mu.Unlock()
+
+	e, ok := h.cache.get(cmd.Key)
+	if !ok {
+		return common.GetResponse{
+			Miss:   true,
+			Quiet:  cmd.Quiet,
+			Opaque: cmd.Opaque,
+			Key:    cmd.Key,
+		}, nil
+	}
+	e.expires = h.cache.expiry(cmd.Exptime)
+	return common.GetResponse{
+		Miss:   false,
+		Quiet:  cmd.Quiet,
+		Opaque: cmd.Opaque,
+		Flags:  e.flags,
+		Key:    cmd.Key,
+		Data:   e.data,
+	}, nil
+}
+
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	h.cache.mu.Lock()
+	defer h.cache.mu.Unlock()
+
+	if _, ok := h.cache.get(cmd.Key); !ok {
+		return common.ErrKeyNotFound
+	}
+	h.cache.remove(h.cache.items[string(cmd.Key)])
+	return nil
+}
+
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	h.cache.mu.Lock()
+	defer h.cache.mu.Unlock()
+
+	e, ok := h.cache.get(cmd.Key)
+	if !ok {
+		return common.ErrKeyNotFound
+	}
+	e.expires = h.cache.expiry(cmd.Exptime)
+	return nil
+}
+
+func (h *Handler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.incrDecr(cmd, func(val uint64) uint64 {
+		return val + cmd.Delta
+	})
+}
+
+func (h *Handler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.incrDecr(cmd, func(val uint64) uint64 {
+		if cmd.Delta > val {
+			return 0
+		}
+		return val - cmd.Delta
+	})
+}
+
+// incrDecr applies op on the counter stored at the key, with the semantics
+// of memcached.
+func (h *Handler) incrDecr(cmd common.IncrDecrRequest, op func(uint64) uint64) (uint64, error) {
+	h.cache.mu.Lock()
+	defer h.cache.mu.Unlock()
+
+	e, ok := h.cache.get(cmd.Key)
+	if !ok {
+		if cmd.Exptime == common.IncrDecrNoCreate {
+			return 0, common.ErrKeyNotFound
+		}
+		h.cache.put(&entry{
+			key:     string(cmd.Key),
+			data:    []byte(strconv.FormatUint(cmd.Initial, 10)),
+			expires: h.cache.expiry(cmd.Exptime),
+		})
+		return cmd.Initial, nil
+	}
+
+	val, err := strconv.ParseUint(string(e.data), 10, 64)
+	if err != nil {
+		return 0, common.ErrBadIncDecValue
+	}
+	val = op(val)
+	h.cache.put(&entry{
+		key:     e.key,
+		data:    []byte(strconv.FormatUint(val, 10)),
+		flags:   e.flags,
+		expires: e.expires,
+	})
+	return val, nil
+}
+
+func (h *Handler) Close() error {
+	return nil
+}
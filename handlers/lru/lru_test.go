@@ -0,0 +1,114 @@
+package lru
+
+import (
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+func set(t *testing.T, h handlers.Handler, key, value string, exptime uint32) {
+	if err := h.Set(common.SetRequest{Key: []byte(key), Data: []byte(value), Exptime: exptime}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// get returns the value of key in h, empty on a miss.
+func get(t *testing.T, h handlers.Handler, key string) string {
+	data, errors := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	var value string
+	for res := range data {
+		value = string(res.Data)
+	}
+	for err := range errors {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func newHandler(t *testing.T, cache *Cache) handlers.Handler {
+	h, err := New(cache)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestEvictsLeastRecentlyUsedBytes(t *testing.T) {
+	// Room for three items of a one byte key and five bytes of data
+	h := newHandler(t, NewCache(3*(1+5+entryOverhead), time.Minute))
+	set(t, h, "a", "value", 0)
+	set(t, h, "b", "value", 0)
+	set(t, h, "c", "value", 0)
+	get(t, h, "a")
+	set(t, h, "d", "value", 0)
+
+	for key, want := range map[string]string{"a": "value", "b": "", "c": "value", "d": "value"} {
+		if got := get(t, h, key); got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+
+	// Items larger than the cache are not stored
+	set(t, h, "e", string(make([]byte, 3*(1+5+entryOverhead))), 0)
+	if got := get(t, h, "e"); got != "" {
+		t.Errorf("got an item larger than the cache")
+	}
+	if got := get(t, h, "a"); got != "value" {
+		t.Errorf("an item larger than the cache evicted the others")
+	}
+}
+
+func TestItemsExpireAfterMaxTTL(t *testing.T) {
+	h := newHandler(t, NewCache(1<<20, 20*time.Millisecond))
+	set(t, h, "forever", "value", 0)
+	set(t, h, "long", "value", 3600)
+	if get(t, h, "forever") == "" || get(t, h, "long") == "" {
+		t.Fatal("items expired right away")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	for _, key := range []string{"forever", "long"} {
+		if got := get(t, h, key); got != "" {
+			t.Errorf("%s: got %q after the maximum TTL, want a miss", key, got)
+		}
+	}
+}
+
+func TestWritesReplaceCachedItems(t *testing.T) {
+	h := newHandler(t, NewCache(1<<20, time.Minute))
+	set(t, h, "key", "first", 0)
+	set(t, h, "key", "second", 0)
+	if got := get(t, h, "key"); got != "second" {
+		t.Errorf("got %q after a set, want the new value", got)
+	}
+
+	if err := h.Touch(common.TouchRequest{Key: []byte("key"), Exptime: 5}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := h.GetE(common.GetRequest{Keys: [][]byte{[]byte("key")}, Opaques: []uint32{0}, Quiet: []bool{false}})
+	if got := <-data; got.Exptime != 5 {
+		t.Errorf("got a TTL of %d after a touch, want 5", got.Exptime)
+	}
+
+	if err := h.Delete(common.DeleteRequest{Key: []byte("key")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, h, "key"); got != "" {
+		t.Errorf("got %q after a delete, want a miss", got)
+	}
+
+	set(t, h, "counter", "1", 0)
+	val, err := h.Incr(common.IncrDecrRequest{Key: []byte("counter"), Delta: 2, Exptime: common.IncrDecrNoCreate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, h, "counter"); val != 3 || got != "3" {
+		t.Errorf("got %d and %q cached after an incr, want 3", val, got)
+	}
+}
@@ -0,0 +1,228 @@
+// Package multiget provides what handlers share to answer gets of several
+// keys, whether they ask for TTLs or not: telling backend failures from
+// answers, gathering the responses of other handlers by key and answering
+// the keys that could not be fetched.
+package multiget
+
+import (
+	"bytes"
+
+	"github.com/netflix/rend/common"
+)
+
+// Response is the response to a key of a get or of a getE.
+type Response interface {
+	common.GetResponse | common.GetEResponse
+}
+
+// Failed tells whether err is a backend failure rather than an answer.
+func Failed(err error) bool {
+	return err == common.ErrTempFailure || err == common.ErrInternal
+}
+
+// Mode tells how keys that could not be fetched because of a backend
+// failure are answered.
+type Mode int
+
+const (
+	// FailClosed fails the whole get.
+	FailClosed Mode = iota
+	// FailOpen answers them as misses.
+	FailOpen
+	// FailKeys answers the other keys, then fails the get. It tells the
+	// handlers wrapping another one which keys failed, it must never
+	// answer clients.
+	FailKeys
+)
+
+// Result is the outcome of a get, by position of the keys in the request.
+type Result[R Response] struct {
+	Responses []R
+	Answered  []bool
+	// Err is the last error the get returned.
+	Err error
+}
+
+// NewResult returns the result of a get of cmd nothing answered yet.
+func NewResult[R Response](cmd common.GetRequest) *Result[R] {
+	return &Result[R]{
+		Responses: make([]R, len(cmd.Keys)),
+		Answered:  make([]bool, len(cmd.Keys)),
+	}
+}
+
+// Read gathers the responses and the error a handler returned to cmd.
+// Responses are expected in the order of the keys, keys that could not be
+// fetched being left out.
+func Read[R Response](cmd common.GetRequest, data <-chan R, errors <-chan error) *Result[R] {
+	r := NewResult[R](cmd)
+	next := 0
+	for res := range data {
+		for idx := next; idx < len(cmd.Keys); idx++ {
+			if bytes.Equal(cmd.Keys[idx], key(res)) {
+				r.Responses[idx] = res
+				r.Answered[idx] = true
+				next = idx + 1
+				break
+			}
+		}
+	}
+	for err := range errors {
+		r.Err = err
+	}
+	return r
+}
+
+// Complete tells whether every key was answered.
+func (r *Result[R]) Complete() bool {
+	for _, answered := range r.Answered {
+		if !answered {
+			return false
+		}
+	}
+	return true
+}
+
+// Failure returns the backend failure that kept the get from answering
+// every key, nil when it answered. Errors such as a malformed key are
+// answers too.
+func (r *Result[R]) Failure() error {
+	if r.Err != nil && !Failed(r.Err) {
+		return nil
+	}
+	if r.Complete() {
+		return nil
+	}
+	if r.Err == nil {
+		return common.ErrInternal
+	}
+	return r.Err
+}
+
+// Missing returns the positions of the keys not answered.
+func (r *Result[R]) Missing() []int {
+	var positions []int
+	for idx, answered := range r.Answered {
+		if !answered {
+			positions = append(positions, idx)
+		}
+	}
+	return positions
+}
+
+// Fill takes the answers of sub, the result of a get of the keys at
+// positions, for the keys r did not get yet.
+func (r *Result[R]) Fill(sub *Result[R], positions []int) {
+	for i, idx := range positions {
+		if sub.Answered[i] && !r.Answered[idx] {
+			r.Responses[idx] = sub.Responses[i]
+			r.Answered[idx] = true
+		}
+	}
+	if sub.Err != nil {
+		r.Err = sub.Err
+	}
+}
+
+// Merge takes the answers of other, the result of another get of the same
+// keys, for the keys r did not get yet.
+func (r *Result[R]) Merge(other *Result[R]) {
+	positions := make([]int, len(other.Answered))
+	for i := range positions {
+		positions[i] = i
+	}
+	r.Fill(other, positions)
+}
+
+// Reply returns r as handlers answer cmd. Keys left unanswered because of
+// a backend failure are answered according to mode, other ones as misses.
+// Errors that are answers, such as a malformed key, fail the whole get.
+// With FailKeys, every key left unanswered is left out of the responses,
+// handlers must answer their misses themselves.
+func Reply[R Response](cmd common.GetRequest, r *Result[R], mode Mode) (<-chan R, <-chan error) {
+	dataOut := make(chan R, len(cmd.Keys))
+	defer close(dataOut)
+	errorOut := make(chan error, 1)
+	defer close(errorOut)
+
+	if r.Err != nil && (!Failed(r.Err) || !r.Complete() && mode == FailClosed) {
+		errorOut <- r.Err
+		return dataOut, errorOut
+	}
+	failed := r.Err != nil && !r.Complete() && mode == FailKeys
+	for idx := range cmd.Keys {
+		switch {
+		case r.Answered[idx]:
+			dataOut <- r.Responses[idx]
+		case !failed:
+			dataOut <- Miss[R](cmd, idx)
+		}
+	}
+	if failed {
+		errorOut <- r.Err
+	}
+	return dataOut, errorOut
+}
+
+// Subset returns the get of the keys of cmd at positions.
+func Subset(cmd common.GetRequest, positions []int) common.GetRequest {
+	sub := common.GetRequest{
+		Keys:        make([][]byte, len(positions)),
+		Opaques:     make([]uint32, len(positions)),
+		Quiet:       make([]bool, len(positions)),
+		NoopOpaque:  cmd.NoopOpaque,
+		NoopEnd:     cmd.NoopEnd,
+		Cas:         cmd.Cas,
+		CasOptional: cmd.CasOptional,
+	}
+	for i, idx := range positions {
+		sub.Keys[i] = cmd.Keys[idx]
+		sub.Opaques[i] = cmd.Opaques[idx]
+		sub.Quiet[i] = cmd.Quiet[idx]
+	}
+	return sub
+}
+
+// Miss returns the miss answering the key at idx in cmd.
+func Miss[R Response](cmd common.GetRequest, idx int) R {
+	var res R
+	switch r := any(&res).(type) {
+	case *common.GetResponse:
+		*r = common.GetResponse{
+			Miss:   true,
+			Quiet:  cmd.Quiet[idx],
+			Opaque: cmd.Opaques[idx],
+			Key:    cmd.Keys[idx],
+		}
+	case *common.GetEResponse:
+		*r = common.GetEResponse{
+			Miss:   true,
+			Quiet:  cmd.Quiet[idx],
+			Opaque: cmd.Opaques[idx],
+			Key:    cmd.Keys[idx],
+		}
+	}
+	return res
+}
+
+// key returns the key res answers.
+func key[R Response](res R) []byte {
+	switch r := any(res).(type) {
+	case common.GetResponse:
+		return r.Key
+	case common.GetEResponse:
+		return r.Key
+	}
+	return nil
+}
+
+// Missed tells whether res is a miss.
+func Missed[R Response](res R) bool {
+	switch r := any(res).(type) {
+	case common.GetResponse:
+		return r.Miss
+	case common.GetEResponse:
+		return r.Miss
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package multiget
+
+import (
+	"testing"
+
+	"github.com/netflix/rend/common"
+)
+
+func request(keys ...string) common.GetRequest {
+	cmd := common.GetRequest{
+		Keys:    make([][]byte, len(keys)),
+		Opaques: make([]uint32, len(keys)),
+		Quiet:   make([]bool, len(keys)),
+	}
+	for i, key := range keys {
+		cmd.Keys[i] = []byte(key)
+		cmd.Opaques[i] = uint32(i)
+	}
+	return cmd
+}
+
+// handler answers the keys of cmd in answers, then err.
+func handler(cmd common.GetRequest, answers map[string]bool, err error) (<-chan common.GetResponse, <-chan error) {
+	data := make(chan common.GetResponse, len(cmd.Keys))
+	errors := make(chan error, 1)
+	for i, key := range cmd.Keys {
+		if answers[string(key)] {
+			data <- common.GetResponse{Key: key, Opaque: cmd.Opaques[i], Data: []byte("value")}
+		}
+	}
+	if err != nil {
+		errors <- err
+	}
+	close(data)
+	close(errors)
+	return data, errors
+}
+
+func TestReadMatchesResponsesToKeys(t *testing.T) {
+	// Keys may be asked for several times
+	cmd := request("a", "b", "a", "c")
+	data, errors := handler(cmd, map[string]bool{"a": true, "c": true}, common.ErrTempFailure)
+	res := Read(cmd, data, errors)
+
+	want := []bool{true, false, true, true}
+	for idx, answered := range want {
+		if res.Answered[idx] != answered {
+			t.Errorf("key %d: got answered %v, want %v", idx, res.Answered[idx], answered)
+		}
+		if answered && res.Responses[idx].Opaque != uint32(idx) {
+			t.Errorf("key %d: got the response of key %d", idx, res.Responses[idx].Opaque)
+		}
+	}
+	if res.Failure() != common.ErrTempFailure {
+		t.Errorf("got failure %v, want %v", res.Failure(), common.ErrTempFailure)
+	}
+}
+
+func TestReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		answers map[string]bool
+		err     error
+		mode    Mode
+		misses  int
+		wantErr error
+	}{
+		{"complete", map[string]bool{"a": true, "b": true}, nil, FailClosed, 0, nil},
+		{"misses", map[string]bool{"a": true}, nil, FailClosed, 1, nil},
+		{"failure closed", map[string]bool{"a": true}, common.ErrTempFailure, FailClosed, 0, common.ErrTempFailure},
+		{"failure open", map[string]bool{"a": true}, common.ErrTempFailure, FailOpen, 1, nil},
+		{"answering error", nil, common.ErrInvalidArgs, FailOpen, 0, common.ErrInvalidArgs},
+	}
+
+	for _, test := range tests {
+		cmd := request("a", "b")
+		data, errors := handler(cmd, test.answers, test.err)
+		data, errors = Reply(cmd, Read(cmd, data, errors), test.mode)
+		responses, misses := 0, 0
+		for res := range data {
+			responses++
+			if res.Miss {
+				misses++
+			}
+		}
+		var err error
+		for e := range errors {
+			err = e
+		}
+
+		if err != test.wantErr {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.wantErr)
+		}
+		if test.wantErr == nil && (responses != len(cmd.Keys) || misses != test.misses) {
+			t.Errorf("%s: got %d responses and %d misses, want %d and %d",
+				test.name, responses, misses, len(cmd.Keys), test.misses)
+		}
+	}
+}
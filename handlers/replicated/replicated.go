@@ -0,0 +1,277 @@
+// Package replicated provides a handler storing each key on several servers
+// of a pool, so that losing one of them does not lose its keys.
+package replicated
+
+import (
+	"strconv"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/BarthV/epoxy/handlers/multiget"
+	"github.com/BarthV/epoxy/hedge"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricReadFailovers = metrics.AddCounter("replicated_read_failovers", nil)
+	MetricWriteFailures = metrics.AddCounter("replicated_write_failures", nil)
+)
+
+// Handler writes to every replica and reads from the first healthy one, or
+// the fastest one when hedging.
+// Replica handlers are expected to report backend failures as errors,
+// never as misses, for reads to fail over. Replicas failing with
+// multiget.FailKeys let keys fail over one by one.
+type Handler struct {
+	replicas []handlers.Handler
+	mode     multiget.Mode
+	hedge    *hedge.Delay
+}
+
+// New returns the constructor of handlers replicating requests on replicas,
+// in order of preference. Keys that could not be fetched from any replica
+// are answered according to mode. Reads slower than the hedge delay are
+// sent to the next replica too, unless hedge is nil.
+func New(replicas []handlers.HandlerConst, mode multiget.Mode, hedge *hedge.Delay) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		h := &Handler{
+			mode:  mode,
+			hedge: hedge,
+		}
+		for _, replica := range replicas {
+			handler, err := replica()
+			if err != nil {
+				h.Close()
+				return nil, err
+			}
+			h.replicas = append(h.replicas, handler)
+		}
+		return h, nil
+	}
+}
+
+// all applies op on every replica in parallel. It returns the index and
+// answer of the first replica that did not fail, or else the failure of
+// the first one.
+func (h *Handler) all(op func(i int, replica handlers.Handler) error) (int, error) {
+	errs := make([]error, len(h.replicas))
+	wg := sync.WaitGroup{}
+	for i, replica := range h.replicas {
+		wg.Add(1)
+		go func(i int, replica handlers.Handler) {
+			defer wg.Done()
+			errs[i] = op(i, replica)
+		}(i, replica)
+	}
+	wg.Wait()
+
+	chosen := -1
+	for i, err := range errs {
+		if multiget.Failed(err) {
+			metrics.IncCounter(MetricWriteFailures)
+			log.WithError(err).WithField("replica", i).Debug("Replica write fail")
+		} else if chosen < 0 {
+			chosen = i
+		}
+	}
+	if chosen < 0 {
+		return 0, errs[0]
+	}
+	return chosen, errs[chosen]
+}
+
+// casReplicaShift places the index of the replica a CAS unique comes from
+// in its top byte, memcached counting uniques up from 1 never reaching it.
+// Conditional writes are then sent to the replica the client read from,
+// whichever one answered its get.
+const casReplicaShift = 56
+
+// tag marks the CAS unique of res as coming from the i-th replica.
+func tag(res *common.GetResponse, i int) {
+	if res.Cas != 0 {
+		res.Cas |= uint64(i) << casReplicaShift
+	}
+}
+
+// cas applies a conditional write on the replica its CAS unique comes
+// from, CAS uniques being local to a server, then stores the result on the
+// others.
+func (h *Handler) cas(cmd common.SetRequest, op func(handlers.Handler, common.SetRequest) error) error {
+	i := int(cmd.Cas >> casReplicaShift)
+	if i >= len(h.replicas) {
+		return common.ErrKeyExists
+	}
+	cmd.Cas &= 1<<casReplicaShift - 1
+	if err := op(h.replicas[i], cmd); err != nil {
+		return err
+	}
+
+	cmd.Cas = 0
+	h.setOthers(i, cmd)
+	return nil
+}
+
+// setOthers stores the result of a write applied on the i-th replica only
+// on the other ones.
+func (h *Handler) setOthers(i int, cmd common.SetRequest) {
+	for j, replica := range h.replicas {
+		if j == i {
+			continue
+		}
+		if err := replica.Set(cmd); multiget.Failed(err) {
+			metrics.IncCounter(MetricWriteFailures)
+			log.WithError(err).WithField("replica", j).Debug("Replica write fail")
+		}
+	}
+}
+
+func (h *Handler) Set(cmd common.SetRequest) error {
+	if cmd.Cas != 0 {
+		return h.cas(cmd, handlers.Handler.Set)
+	}
+	_, err := h.all(func(_ int, r handlers.Handler) error { return r.Set(cmd) })
+	return err
+}
+
+func (h *Handler) Add(cmd common.SetRequest) error {
+	_, err := h.all(func(_ int, r handlers.Handler) error { return r.Add(cmd) })
+	return err
+}
+
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	if cmd.Cas != 0 {
+		return h.cas(cmd, handlers.Handler.Replace)
+	}
+	_, err := h.all(func(_ int, r handlers.Handler) error { return r.Replace(cmd) })
+	return err
+}
+
+func (h *Handler) Append(cmd common.SetRequest) error {
+	_, err := h.all(func(_ int, r handlers.Handler) error { return r.Append(cmd) })
+	return err
+}
+
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	_, err := h.all(func(_ int, r handlers.Handler) error { return r.Prepend(cmd) })
+	return err
+}
+
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	return read(h, cmd, handlers.Handler.Get)
+}
+
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	return read(h, cmd, handlers.Handler.GetE)
+}
+
+// read gets the keys of cmd with get from the first replica answering.
+func read[R multiget.Response](h *Handler, cmd common.GetRequest, get func(handlers.Handler, common.GetRequest) (<-chan R, <-chan error)) (<-chan R, <-chan error) {
+	results := make([]*multiget.Result[R], len(h.replicas))
+	attempts := make([]func() error, len(h.replicas))
+	for i, replica := range h.replicas {
+		i, replica := i, replica
+		attempts[i] = func() error {
+			data, errors := get(replica, cmd)
+			results[i] = multiget.Read(cmd, data, errors)
+			for j := range results[i].Responses {
+				if res, ok := any(&results[i].Responses[j]).(*common.GetResponse); ok {
+					tag(res, i)
+				}
+			}
+			return results[i].Failure()
+		}
+	}
+
+	chosen, errs := h.hedge.Race(attempts...)
+	for i, err := range errs {
+		if err != nil {
+			metrics.IncCounter(MetricReadFailovers)
+			log.WithError(err).WithField("replica", i).Debug("Replica get fail, trying next one")
+		}
+	}
+	if chosen >= 0 {
+		return multiget.Reply(cmd, results[chosen], multiget.FailClosed)
+	}
+
+	// Every replica failed, each key is answered by the first replica
+	// that could fetch it
+	merged := multiget.NewResult[R](cmd)
+	for _, res := range results {
+		merged.Merge(res)
+	}
+	return multiget.Reply(cmd, merged, h.mode)
+}
+
+// GAT touches the item on every replica, the answer comes from the first
+// healthy one.
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	responses := make([]common.GetResponse, len(h.replicas))
+	i, err := h.all(func(i int, r handlers.Handler) error {
+		res, err := r.GAT(cmd)
+		tag(&res, i)
+		responses[i] = res
+		return err
+	})
+	return responses[i], err
+}
+
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	_, err := h.all(func(_ int, r handlers.Handler) error { return r.Delete(cmd) })
+	return err
+}
+
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	_, err := h.all(func(_ int, r handlers.Handler) error { return r.Touch(cmd) })
+	return err
+}
+
+func (h *Handler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.counter(cmd, handlers.Handler.Incr)
+}
+
+func (h *Handler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.counter(cmd, handlers.Handler.Decr)
+}
+
+// counter applies op on the first healthy replica only, then stores the
+// new value on the others, so that replicas which missed a write do not
+// keep counting from another value. Memcached not telling the TTL of a
+// counter, the others get the one it would be created with.
+func (h *Handler) counter(cmd common.IncrDecrRequest, op func(handlers.Handler, common.IncrDecrRequest) (uint64, error)) (uint64, error) {
+	var val uint64
+	var err error
+	for i, replica := range h.replicas {
+		val, err = op(replica, cmd)
+		if multiget.Failed(err) {
+			metrics.IncCounter(MetricWriteFailures)
+			log.WithError(err).WithField("replica", i).Debug("Replica counter fail, trying next one")
+			continue
+		}
+		if err == nil {
+			exptime := cmd.Exptime
+			if exptime == common.IncrDecrNoCreate {
+				exptime = 0
+			}
+			h.setOthers(i, common.SetRequest{
+				Key:     cmd.Key,
+				Exptime: exptime,
+				Data:    []byte(strconv.FormatUint(val, 10)),
+			})
+		}
+		return val, err
+	}
+	return val, err
+}
+
+func (h *Handler) Close() error {
+	var err error
+	for _, replica := range h.replicas {
+		if cerr := replica.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
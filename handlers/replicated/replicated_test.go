@@ -0,0 +1,133 @@
+package replicated
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/BarthV/epoxy/handlers/multiget"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// replica is a handler holding a single item with a CAS unique. Its gets
+// fail when down, and it records the writes it receives.
+type replica struct {
+	handlers.Handler
+	cas     uint64
+	counter uint64
+	down    bool
+
+	mu     sync.Mutex
+	writes []common.SetRequest
+}
+
+func (r *replica) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	res := multiget.NewResult[common.GetResponse](cmd)
+	if r.down {
+		res.Err = common.ErrTempFailure
+		return multiget.Reply(cmd, res, multiget.FailKeys)
+	}
+	for idx, key := range cmd.Keys {
+		res.Responses[idx] = common.GetResponse{Key: key, Data: []byte("value"), Cas: r.cas}
+		res.Answered[idx] = true
+	}
+	return multiget.Reply(cmd, res, multiget.FailKeys)
+}
+
+func (r *replica) Set(cmd common.SetRequest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writes = append(r.writes, cmd)
+	return nil
+}
+
+func (r *replica) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	if r.down {
+		return 0, common.ErrTempFailure
+	}
+	r.counter += cmd.Delta
+	return r.counter, nil
+}
+
+func (r *replica) Close() error { return nil }
+
+// handler returns a replicated handler of replicas.
+func handler(t *testing.T, replicas []*replica) handlers.Handler {
+	consts := make([]handlers.HandlerConst, len(replicas))
+	for i, r := range replicas {
+		r := r
+		consts[i] = func() (handlers.Handler, error) { return r, nil }
+	}
+	h, err := New(consts, multiget.FailClosed, nil)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestCasGoesToTheReplicaReadFrom(t *testing.T) {
+	replicas := []*replica{{cas: 3, down: true}, {cas: 7}, {cas: 9}}
+	h := handler(t, replicas)
+
+	data, errors := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte("key")},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+		Cas:     true,
+	})
+	var cas uint64
+	for res := range data {
+		cas = res.Cas
+	}
+	for err := range errors {
+		t.Fatal(err)
+	}
+	if cas&(1<<casReplicaShift-1) != 7 {
+		t.Fatalf("got CAS unique %#x, want the one of the second replica", cas)
+	}
+
+	if err := h.Set(common.SetRequest{Key: []byte("key"), Data: []byte("new"), Cas: cas}); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range replicas {
+		if len(r.writes) != 1 {
+			t.Fatalf("replica %d: got %d writes, want 1", i, len(r.writes))
+		}
+		want := uint64(0)
+		if i == 1 {
+			want = 7
+		}
+		if r.writes[0].Cas != want {
+			t.Errorf("replica %d: got a write with CAS %d, want %d", i, r.writes[0].Cas, want)
+		}
+	}
+
+	if err := h.Set(common.SetRequest{Key: []byte("key"), Cas: 7 | 5<<casReplicaShift}); err != common.ErrKeyExists {
+		t.Errorf("got %v for the CAS unique of an unknown replica, want %v", err, common.ErrKeyExists)
+	}
+}
+
+func TestCounterAppliedOnceThenStored(t *testing.T) {
+	replicas := []*replica{{down: true}, {counter: 5}, {counter: 1}}
+	h := handler(t, replicas)
+
+	val, err := h.Incr(common.IncrDecrRequest{Key: []byte("key"), Delta: 2, Exptime: common.IncrDecrNoCreate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != 7 {
+		t.Errorf("got %d, want the counter of the first healthy replica", val)
+	}
+	if replicas[2].counter != 1 {
+		t.Errorf("third replica counted to %d, want it left to the second one", replicas[2].counter)
+	}
+	for _, i := range []int{0, 2} {
+		writes := replicas[i].writes
+		if len(writes) != 1 || string(writes[0].Data) != "7" || writes[0].Exptime != 0 {
+			t.Errorf("replica %d: got writes %+v, want the new value stored", i, writes)
+		}
+	}
+	if len(replicas[1].writes) != 0 {
+		t.Errorf("second replica got %d writes, want none", len(replicas[1].writes))
+	}
+}
@@ -0,0 +1,206 @@
+// Package router provides a handler sending each key to the pool of
+// memcached servers its route points to.
+package router
+
+import (
+	"bytes"
+	"regexp"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/BarthV/epoxy/handlers/multiget"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// Route sends the keys starting with Prefix, or matching Regexp when set,
+// to the pool named Pool.
+type Route struct {
+	Prefix string
+	Regexp *regexp.Regexp
+	Pool   string
+}
+
+func (r Route) match(key []byte) bool {
+	if r.Regexp != nil {
+		return r.Regexp.Match(key)
+	}
+	return bytes.HasPrefix(key, []byte(r.Prefix))
+}
+
+type route struct {
+	Route
+	handler handlers.Handler
+}
+
+type Handler struct {
+	routes   []route
+	fallback handlers.Handler
+	pools    []handlers.Handler
+}
+
+// New returns the constructor of handlers routing requests among pools,
+// each connection getting its own handler on every pool. Keys are matched
+// against routes in order, the ones no route matches go to the fallback
+// pool.
+func New(pools map[string]handlers.HandlerConst, routes []Route, fallback string) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		h := &Handler{}
+		byName := make(map[string]handlers.Handler, len(pools))
+		for name, pool := range pools {
+			handler, err := pool()
+			if err != nil {
+				h.Close()
+				return nil, err
+			}
+			byName[name] = handler
+			h.pools = append(h.pools, handler)
+		}
+
+		h.fallback = byName[fallback]
+		for _, r := range routes {
+			h.routes = append(h.routes, route{Route: r, handler: byName[r.Pool]})
+		}
+		return h, nil
+	}
+}
+
+// pick returns the handler of the pool owning key.
+func (h *Handler) pick(key []byte) handlers.Handler {
+	for _, r := range h.routes {
+		if r.match(key) {
+			return r.handler
+		}
+	}
+	return h.fallback
+}
+
+func (h *Handler) Set(cmd common.SetRequest) error {
+	return h.pick(cmd.Key).Set(cmd)
+}
+
+func (h *Handler) Add(cmd common.SetRequest) error {
+	return h.pick(cmd.Key).Add(cmd)
+}
+
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	return h.pick(cmd.Key).Replace(cmd)
+}
+
+func (h *Handler) Append(cmd common.SetRequest) error {
+	return h.pick(cmd.Key).Append(cmd)
+}
+
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	return h.pick(cmd.Key).Prepend(cmd)
+}
+
+// subRequest is the part of a multi-get sent to a single pool, along with
+// the position of each of its keys in the original request.
+type subRequest struct {
+	handler handlers.Handler
+	cmd     common.GetRequest
+	index   []int
+}
+
+// split groups the keys of cmd by pool. A request owned by a single pool is
+// returned as is.
+func (h *Handler) split(cmd common.GetRequest) []*subRequest {
+	var subs []*subRequest
+	byHandler := make(map[handlers.Handler]*subRequest)
+	for idx, key := range cmd.Keys {
+		handler := h.pick(key)
+		sub, ok := byHandler[handler]
+		if !ok {
+			sub = &subRequest{
+				handler: handler,
+				cmd: common.GetRequest{
+					NoopOpaque:  cmd.NoopOpaque,
+					NoopEnd:     cmd.NoopEnd,
+					Cas:         cmd.Cas,
+					CasOptional: cmd.CasOptional,
+				},
+			}
+			byHandler[handler] = sub
+			subs = append(subs, sub)
+		}
+		sub.cmd.Keys = append(sub.cmd.Keys, key)
+		sub.cmd.Opaques = append(sub.cmd.Opaques, cmd.Opaques[idx])
+		sub.cmd.Quiet = append(sub.cmd.Quiet, cmd.Quiet[idx])
+		sub.index = append(sub.index, idx)
+	}
+	if len(subs) == 1 {
+		subs[0].cmd = cmd
+	}
+	return subs
+}
+
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	return routeGet(h, cmd, handlers.Handler.Get)
+}
+
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	return routeGet(h, cmd, handlers.Handler.GetE)
+}
+
+// routeGet gets the keys of cmd with get from the pools owning them.
+func routeGet[R multiget.Response](h *Handler, cmd common.GetRequest, get func(handlers.Handler, common.GetRequest) (<-chan R, <-chan error)) (<-chan R, <-chan error) {
+	subs := h.split(cmd)
+	if len(subs) == 1 {
+		return get(subs[0].handler, cmd)
+	}
+
+	// Pools are queried in parallel, responses are sent back in request
+	// order once every pool answered.
+	results := make([]*multiget.Result[R], len(subs))
+	wg := sync.WaitGroup{}
+	for i, sub := range subs {
+		wg.Add(1)
+		go func(i int, sub *subRequest) {
+			defer wg.Done()
+			data, errors := get(sub.handler, sub.cmd)
+			results[i] = multiget.Read(sub.cmd, data, errors)
+		}(i, sub)
+	}
+	wg.Wait()
+
+	res := multiget.NewResult[R](cmd)
+	for i, sub := range subs {
+		if err := results[i].Err; err != nil {
+			log.WithError(err).Debug("Routed get fail")
+		}
+		res.Fill(results[i], sub.index)
+	}
+	return multiget.Reply(cmd, res, multiget.FailClosed)
+}
+
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	return h.pick(cmd.Key).GAT(cmd)
+}
+
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	return h.pick(cmd.Key).Delete(cmd)
+}
+
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	return h.pick(cmd.Key).Touch(cmd)
+}
+
+func (h *Handler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.pick(cmd.Key).Incr(cmd)
+}
+
+func (h *Handler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.pick(cmd.Key).Decr(cmd)
+}
+
+func (h *Handler) Close() error {
+	var err error
+	for _, pool := range h.pools {
+		if cerr := pool.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,149 @@
+package router
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// pool is a handler answering gets with its name as value, or failing them
+// when down. It records the keys written to it.
+type pool struct {
+	handlers.Handler
+	name string
+	down bool
+	sets []string
+}
+
+func (p *pool) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	data := make(chan common.GetResponse, len(cmd.Keys))
+	errors := make(chan error, 1)
+	defer close(data)
+	defer close(errors)
+	if p.down {
+		errors <- common.ErrTempFailure
+		return data, errors
+	}
+	for idx, key := range cmd.Keys {
+		data <- common.GetResponse{
+			Key:    key,
+			Opaque: cmd.Opaques[idx],
+			Quiet:  cmd.Quiet[idx],
+			Data:   []byte(p.name),
+		}
+	}
+	return data, errors
+}
+
+func (p *pool) Set(cmd common.SetRequest) error {
+	p.sets = append(p.sets, string(cmd.Key))
+	return nil
+}
+
+func (p *pool) Close() error { return nil }
+
+// newRouter returns a router among pools named prefix, regex and default,
+// the default one getting the keys no route matches.
+func newRouter(t *testing.T, routes []Route) (handlers.Handler, map[string]*pool) {
+	pools := map[string]*pool{}
+	consts := map[string]handlers.HandlerConst{}
+	for _, name := range []string{"prefix", "regex", "default"} {
+		p := &pool{name: name}
+		pools[name] = p
+		consts[name] = func() (handlers.Handler, error) { return p, nil }
+	}
+	h, err := New(consts, routes, "default")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, pools
+}
+
+func TestRoutesMatchedInOrder(t *testing.T) {
+	prefix := Route{Prefix: "user:", Pool: "prefix"}
+	regex := Route{Regexp: regexp.MustCompile(`^user:[0-9]+$`), Pool: "regex"}
+	for _, tt := range []struct {
+		name   string
+		routes []Route
+		keys   map[string]string
+	}{
+		{
+			name:   "prefix first",
+			routes: []Route{prefix, regex},
+			keys:   map[string]string{"user:1": "prefix", "user:a": "prefix", "feed:1": "default"},
+		},
+		{
+			name:   "regex first",
+			routes: []Route{regex, prefix},
+			keys:   map[string]string{"user:1": "regex", "user:a": "prefix", "feed:1": "default"},
+		},
+		{
+			name: "no routes",
+			keys: map[string]string{"user:1": "default"},
+		},
+	} {
+		h, pools := newRouter(t, tt.routes)
+		for key, want := range tt.keys {
+			if err := h.Set(common.SetRequest{Key: []byte(key)}); err != nil {
+				t.Fatal(err)
+			}
+			if got := pools[want].sets; len(got) == 0 || got[len(got)-1] != key {
+				t.Errorf("%s: %s not written to the %s pool", tt.name, key, want)
+			}
+		}
+	}
+}
+
+func TestGetAcrossPoolsKeepsRequestOrder(t *testing.T) {
+	h, _ := newRouter(t, []Route{
+		{Prefix: "user:", Pool: "prefix"},
+		{Regexp: regexp.MustCompile(`^feed:`), Pool: "regex"},
+	})
+	cmd := common.GetRequest{
+		Keys:    [][]byte{[]byte("feed:1"), []byte("user:1"), []byte("other"), []byte("user:2")},
+		Opaques: []uint32{1, 2, 3, 4},
+		Quiet:   []bool{false, true, false, true},
+	}
+	data, errors := h.Get(cmd)
+	var got []common.GetResponse
+	for res := range data {
+		got = append(got, res)
+	}
+	for err := range errors {
+		t.Fatal(err)
+	}
+
+	want := []common.GetResponse{
+		{Key: []byte("feed:1"), Opaque: 1, Quiet: false, Data: []byte("regex")},
+		{Key: []byte("user:1"), Opaque: 2, Quiet: true, Data: []byte("prefix")},
+		{Key: []byte("other"), Opaque: 3, Quiet: false, Data: []byte("default")},
+		{Key: []byte("user:2"), Opaque: 4, Quiet: true, Data: []byte("prefix")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestGetFailsClosedWhenAPoolFails(t *testing.T) {
+	h, pools := newRouter(t, []Route{{Prefix: "user:", Pool: "prefix"}})
+	pools["prefix"].down = true
+
+	data, errors := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte("other"), []byte("user:1")},
+		Opaques: []uint32{1, 2},
+		Quiet:   []bool{false, false},
+	})
+	for res := range data {
+		t.Errorf("got a response for %q along with the failure", res.Key)
+	}
+	var got error
+	for err := range errors {
+		got = err
+	}
+	if got != common.ErrTempFailure {
+		t.Errorf("got error %v, want %v", got, common.ErrTempFailure)
+	}
+}
@@ -0,0 +1,360 @@
+// Package shadow provides a handler mirroring a sample of the requests to
+// a shadow pool, to validate a new memcached version or instance type with
+// production traffic before cutting over. Mirrored gets are compared with
+// the answers of the primary pool and mismatches are reported. Mirroring
+// is asynchronous and never slows down clients: when the shadow pool lags
+// behind, requests are dropped instead of queued without bound. Writes
+// are mirrored once applied by the primary pool, and the requests of a key
+// reach the shadow pool in order.
+package shadow
+
+import (
+	"bytes"
+	"hash/fnv"
+	"math"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/BarthV/epoxy/handlers/multiget"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+const (
+	// workers send mirrored requests to the shadow pool, each from its own
+	// queue of queueSize requests at most.
+	workers   = 16
+	queueSize = 4096
+)
+
+var (
+	MetricMirrored        = metrics.AddCounter("shadow_mirrored", nil)
+	MetricDropped         = metrics.AddCounter("shadow_dropped", nil)
+	MetricErrors          = metrics.AddCounter("shadow_errors", nil)
+	MetricMatches         = metrics.AddCounter("shadow_matches", nil)
+	MetricHitMismatches   = metrics.AddCounter("shadow_hit_mismatches", nil)
+	MetricValueMismatches = metrics.AddCounter("shadow_value_mismatches", nil)
+)
+
+// Mode tells which requests are mirrored.
+type Mode int
+
+const (
+	// Gets mirrors gets only, the shadow pool being filled otherwise.
+	Gets Mode = 1 << iota
+	// Sets mirrors writes only.
+	Sets
+	// Both mirrors gets and writes.
+	Both = Gets | Sets
+)
+
+// ParseMode returns the mode named gets, sets or both.
+func ParseMode(name string) (Mode, bool) {
+	switch name {
+	case "gets":
+		return Gets, true
+	case "sets":
+		return Sets, true
+	case "both":
+		return Both, true
+	}
+	return 0, false
+}
+
+// mirror is a request to the shadow pool.
+type mirror func(shadow handlers.Handler)
+
+// Handler passes requests to the primary pool and mirrors the sampled ones
+// to the shadow pool.
+type Handler struct {
+	primary   handlers.Handler
+	queues    []chan mirror
+	threshold uint64
+	mode      Mode
+}
+
+// New returns the constructor of handlers mirroring the rate fraction of
+// the keys, between 0 and 1, to the shadow pool. Keys are sampled by hash,
+// so that the gets and writes of a key are all mirrored or not at all.
+// Shadow handlers must report backend failures as errors, for them not to
+// be taken for misses.
+func New(primary, shadow handlers.HandlerConst, rate float64, mode Mode) handlers.HandlerConst {
+	// Keys are spread among workers, for the requests of a key to be sent
+	// in order
+	queues := make([]chan mirror, workers)
+	for i := range queues {
+		queues[i] = make(chan mirror, queueSize)
+		go work(shadow, queues[i])
+	}
+	threshold := uint64(rate * (math.MaxUint32 + 1))
+	return func() (handlers.Handler, error) {
+		p, err := primary()
+		if err != nil {
+			return nil, err
+		}
+		return &Handler{
+			primary:   p,
+			queues:    queues,
+			threshold: threshold,
+			mode:      mode,
+		}, nil
+	}
+}
+
+// work sends the mirrored requests of queue to a handler of the shadow
+// pool.
+func work(shadow handlers.HandlerConst, queue <-chan mirror) {
+	s, err := shadow()
+	if err != nil {
+		log.WithError(err).Error("Shadow handler creation failed")
+		return
+	}
+	defer s.Close()
+	for m := range queue {
+		m(s)
+	}
+}
+
+// hash is the hash keys are sampled and spread among workers by.
+func hash(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32()
+}
+
+// shard returns the index of the queue of key.
+func (h *Handler) shard(key []byte) uint32 {
+	return hash(key) % uint32(len(h.queues))
+}
+
+// sampled tells whether key is mirrored.
+func (h *Handler) sampled(key []byte) bool {
+	return uint64(hash(key)) < h.threshold
+}
+
+// send queues m, a request about key, behind the previous ones about it.
+// It drops m when the shadow pool lags behind.
+func (h *Handler) send(key []byte, m mirror) {
+	select {
+	case h.queues[h.shard(key)] <- m:
+		metrics.IncCounter(MetricMirrored)
+	default:
+		metrics.IncCounter(MetricDropped)
+	}
+}
+
+// failed counts a shadow request failing on a backend error.
+func failed(err error) {
+	if multiget.Failed(err) {
+		metrics.IncCounter(MetricErrors)
+		log.WithError(err).Debug("Shadow request fail")
+	}
+}
+
+// write mirrors the write of key when sampled, once the primary pool
+// applied it. Writes failing on the primary pool, which left it as it was,
+// are not mirrored.
+func (h *Handler) write(key []byte, err error, op func(shadow handlers.Handler) error) {
+	if err != nil || h.mode&Sets == 0 || !h.sampled(key) {
+		return
+	}
+	h.send(key, func(s handlers.Handler) {
+		failed(op(s))
+	})
+}
+
+// cas mirrors a write, as a plain set when it was a conditional one since
+// CAS uniques are local to servers.
+func (h *Handler) cas(cmd common.SetRequest, err error, op func(handlers.Handler, common.SetRequest) error) {
+	if cmd.Cas != 0 {
+		cmd.Cas = 0
+		op = handlers.Handler.Set
+	}
+	h.write(cmd.Key, err, func(s handlers.Handler) error { return op(s, cmd) })
+}
+
+func (h *Handler) Set(cmd common.SetRequest) error {
+	err := h.primary.Set(cmd)
+	h.cas(cmd, err, handlers.Handler.Set)
+	return err
+}
+
+func (h *Handler) Add(cmd common.SetRequest) error {
+	err := h.primary.Add(cmd)
+	h.write(cmd.Key, err, func(s handlers.Handler) error { return s.Add(cmd) })
+	return err
+}
+
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	err := h.primary.Replace(cmd)
+	h.cas(cmd, err, handlers.Handler.Replace)
+	return err
+}
+
+func (h *Handler) Append(cmd common.SetRequest) error {
+	err := h.primary.Append(cmd)
+	h.write(cmd.Key, err, func(s handlers.Handler) error { return s.Append(cmd) })
+	return err
+}
+
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	err := h.primary.Prepend(cmd)
+	h.write(cmd.Key, err, func(s handlers.Handler) error { return s.Prepend(cmd) })
+	return err
+}
+
+// Get answers from the primary pool, then mirrors the sampled keys to
+// compare the answers of the shadow pool with the primary ones. CAS uniques
+// are local to servers and left out of comparisons.
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	data, errors := h.primary.Get(cmd)
+	if h.mode&Gets == 0 {
+		return data, errors
+	}
+
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	defer close(dataOut)
+	errorOut := make(chan error, 1)
+	defer close(errorOut)
+
+	var responses []common.GetResponse
+	for res := range data {
+		dataOut <- res
+		if h.sampled(res.Key) {
+			responses = append(responses, res)
+		}
+	}
+	var err error
+	for e := range errors {
+		err = e
+	}
+	if err != nil {
+		errorOut <- err
+		return dataOut, errorOut
+	}
+
+	// Keys are compared by the workers their writes go through, for
+	// comparisons to come after the writes preceding them
+	shards := map[uint32][]common.GetResponse{}
+	for _, res := range responses {
+		shard := h.shard(res.Key)
+		shards[shard] = append(shards[shard], res)
+	}
+	for _, responses := range shards {
+		responses := responses
+		h.send(responses[0].Key, func(s handlers.Handler) {
+			compare(s, responses)
+		})
+	}
+	return dataOut, errorOut
+}
+
+// outcome is the result of comparing the answers of both pools to a get.
+type outcome int
+
+const (
+	match outcome = iota
+	hitMismatch
+	valueMismatch
+)
+
+// compare gets from the shadow pool the keys the primary pool answered
+// with responses, reports the mismatches and returns the outcome of every
+// key compared.
+func compare(s handlers.Handler, responses []common.GetResponse) []outcome {
+	cmd := common.GetRequest{
+		Keys:    make([][]byte, len(responses)),
+		Opaques: make([]uint32, len(responses)),
+		Quiet:   make([]bool, len(responses)),
+	}
+	primary := make(map[string]common.GetResponse, len(responses))
+	for i, res := range responses {
+		cmd.Keys[i] = res.Key
+		primary[string(res.Key)] = res
+	}
+
+	data, errors := s.Get(cmd)
+	var shadowed []common.GetResponse
+	for res := range data {
+		shadowed = append(shadowed, res)
+	}
+	for err := range errors {
+		failed(err)
+		return nil
+	}
+
+	var outcomes []outcome
+	for _, res := range shadowed {
+		p, ok := primary[string(res.Key)]
+		if !ok {
+			continue
+		}
+		fields := log.Fields{
+			"key":          string(res.Key),
+			"primary_miss": p.Miss,
+			"shadow_miss":  res.Miss,
+		}
+		switch {
+		case p.Miss != res.Miss:
+			metrics.IncCounter(MetricHitMismatches)
+			log.WithFields(fields).Info("Shadow hit mismatch")
+			outcomes = append(outcomes, hitMismatch)
+		case !p.Miss && (p.Flags != res.Flags || !bytes.Equal(p.Data, res.Data)):
+			metrics.IncCounter(MetricValueMismatches)
+			log.WithFields(fields).Info("Shadow value mismatch")
+			outcomes = append(outcomes, valueMismatch)
+		default:
+			metrics.IncCounter(MetricMatches)
+			outcomes = append(outcomes, match)
+		}
+	}
+	return outcomes
+}
+
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	return h.primary.GetE(cmd)
+}
+
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	res, err := h.primary.GAT(cmd)
+	h.write(cmd.Key, err, func(s handlers.Handler) error {
+		_, err := s.GAT(cmd)
+		return err
+	})
+	return res, err
+}
+
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	err := h.primary.Delete(cmd)
+	h.write(cmd.Key, err, func(s handlers.Handler) error { return s.Delete(cmd) })
+	return err
+}
+
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	err := h.primary.Touch(cmd)
+	h.write(cmd.Key, err, func(s handlers.Handler) error { return s.Touch(cmd) })
+	return err
+}
+
+func (h *Handler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	val, err := h.primary.Incr(cmd)
+	h.write(cmd.Key, err, func(s handlers.Handler) error {
+		_, err := s.Incr(cmd)
+		return err
+	})
+	return val, err
+}
+
+func (h *Handler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	val, err := h.primary.Decr(cmd)
+	h.write(cmd.Key, err, func(s handlers.Handler) error {
+		_, err := s.Decr(cmd)
+		return err
+	})
+	return val, err
+}
+
+func (h *Handler) Close() error {
+	return h.primary.Close()
+}
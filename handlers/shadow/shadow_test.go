@@ -0,0 +1,197 @@
+package shadow
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// pool is a handler holding items, its requests failing with err when set.
+// It records the values set.
+type pool struct {
+	handlers.Handler
+	items map[string]string
+	err   error
+	sets  []string
+}
+
+func (p *pool) Set(cmd common.SetRequest) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.sets = append(p.sets, string(cmd.Data))
+	return nil
+}
+
+func (p *pool) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	data := make(chan common.GetResponse, len(cmd.Keys))
+	errors := make(chan error, 1)
+	defer close(data)
+	defer close(errors)
+	if p.err != nil {
+		errors <- p.err
+		return data, errors
+	}
+	for idx, key := range cmd.Keys {
+		value, ok := p.items[string(key)]
+		data <- common.GetResponse{Key: key, Opaque: cmd.Opaques[idx], Data: []byte(value), Miss: !ok}
+	}
+	return data, errors
+}
+
+// handler returns a handler mirroring the rate fraction of the keys to
+// queues of size requests, no worker emptying them.
+func handler(primary *pool, rate float64, mode Mode, queues, size int) *Handler {
+	h := &Handler{
+		primary:   primary,
+		queues:    make([]chan mirror, queues),
+		threshold: uint64(rate * (math.MaxUint32 + 1)),
+		mode:      mode,
+	}
+	for i := range h.queues {
+		h.queues[i] = make(chan mirror, size)
+	}
+	return h
+}
+
+// queued returns the number of mirrored requests waiting in h.
+func queued(h *Handler) int {
+	n := 0
+	for _, queue := range h.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// drain sends the mirrored requests waiting in h to shadow.
+func drain(h *Handler, shadow handlers.Handler) {
+	for _, queue := range h.queues {
+		for len(queue) > 0 {
+			(<-queue)(shadow)
+		}
+	}
+}
+
+func get(h handlers.Handler, key string) {
+	data, errors := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	for range data {
+	}
+	for range errors {
+	}
+}
+
+func TestKeysAreSampledByHash(t *testing.T) {
+	for _, tt := range []struct {
+		rate     float64
+		min, max int
+	}{
+		{rate: 0, min: 0, max: 0},
+		{rate: 0.25, min: 200, max: 300},
+		{rate: 1, min: 1000, max: 1000},
+	} {
+		h := handler(&pool{}, tt.rate, Both, 1, 1)
+		sampled := 0
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("key%d", i))
+			if h.sampled(key) != h.sampled(key) {
+				t.Fatalf("rate %v: %s sampled only sometimes", tt.rate, key)
+			}
+			if h.sampled(key) {
+				sampled++
+			}
+		}
+		if sampled < tt.min || sampled > tt.max {
+			t.Errorf("rate %v: %d keys out of 1000 sampled, want between %d and %d", tt.rate, sampled, tt.min, tt.max)
+		}
+	}
+}
+
+func TestModeFiltersMirroredRequests(t *testing.T) {
+	for _, tt := range []struct {
+		mode       Mode
+		gets, sets int
+	}{
+		{mode: Gets, gets: 1, sets: 0},
+		{mode: Sets, gets: 0, sets: 1},
+		{mode: Both, gets: 1, sets: 1},
+	} {
+		primary := &pool{items: map[string]string{"key": "value"}}
+		h := handler(primary, 1, tt.mode, 4, 8)
+		if err := h.Set(common.SetRequest{Key: []byte("key"), Data: []byte("value")}); err != nil {
+			t.Fatal(err)
+		}
+		if got := queued(h); got != tt.sets {
+			t.Errorf("mode %d: %d sets mirrored, want %d", tt.mode, got, tt.sets)
+		}
+		get(h, "key")
+		if got := queued(h) - tt.sets; got != tt.gets {
+			t.Errorf("mode %d: %d gets mirrored, want %d", tt.mode, got, tt.gets)
+		}
+	}
+}
+
+func TestWritesMirroredInOrderOnceApplied(t *testing.T) {
+	primary := &pool{}
+	h := handler(primary, 1, Sets, 4, 8)
+	for _, value := range []string{"1", "2", "3"} {
+		if err := h.Set(common.SetRequest{Key: []byte("key"), Data: []byte(value)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	primary.err = common.ErrTempFailure
+	h.Set(common.SetRequest{Key: []byte("key"), Data: []byte("failed")})
+
+	shadow := &pool{}
+	drain(h, shadow)
+	if want := []string{"1", "2", "3"}; !reflect.DeepEqual(shadow.sets, want) {
+		t.Errorf("shadow got sets %q, want %q", shadow.sets, want)
+	}
+}
+
+func TestMirroredRequestsDroppedWhenQueueFull(t *testing.T) {
+	h := handler(&pool{}, 1, Sets, 1, 2)
+	for _, value := range []string{"1", "2", "3"} {
+		if err := h.Set(common.SetRequest{Key: []byte("key"), Data: []byte(value)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shadow := &pool{}
+	drain(h, shadow)
+	if want := []string{"1", "2"}; !reflect.DeepEqual(shadow.sets, want) {
+		t.Errorf("shadow got sets %q, want %q", shadow.sets, want)
+	}
+}
+
+func TestCompareReportsMismatches(t *testing.T) {
+	shadow := &pool{items: map[string]string{
+		"match":    "value",
+		"value":    "other",
+		"shadowed": "value",
+	}}
+	responses := []common.GetResponse{
+		{Key: []byte("match"), Data: []byte("value")},
+		{Key: []byte("value"), Data: []byte("value")},
+		{Key: []byte("missing"), Data: []byte("value")},
+		{Key: []byte("shadowed"), Miss: true},
+		{Key: []byte("absent"), Miss: true},
+	}
+	want := []outcome{match, valueMismatch, hitMismatch, hitMismatch, match}
+	if got := compare(shadow, responses); !reflect.DeepEqual(got, want) {
+		t.Errorf("got outcomes %v, want %v", got, want)
+	}
+
+	// Failures of the shadow pool are not mismatches
+	shadow.err = common.ErrTempFailure
+	if got := compare(shadow, responses); len(got) != 0 {
+		t.Errorf("got outcomes %v from a failed shadow pool, want none", got)
+	}
+}
@@ -0,0 +1,162 @@
+// Package hedge provides hedged requests: when a request has not been
+// answered after a delay most requests answer within, an equivalent one is
+// sent elsewhere and the first answer is used, as described in "The Tail
+// at Scale". Slow servers then cost their clients that delay, instead of
+// the full timeout.
+package hedge
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+const (
+	// samples is the number of recent latencies the delay is computed
+	// from, it is refreshed every refresh samples.
+	samples = 1024
+	refresh = 128
+)
+
+// Delay tracks the latency of recent requests to hedge the ones slower
+// than its percentile.
+type Delay struct {
+	percentile float64
+	max        time.Duration
+
+	// current is the hedging delay, in nanoseconds.
+	current int64
+
+	metricHedges uint32
+	metricWins   uint32
+	metricDelay  uint32
+
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	count   int
+}
+
+// NewDelay returns a delay hedging the requests slower than the percentile
+// of recent latencies, between 0 and 1, or than max. Until enough
+// latencies are known, requests are hedged after max. tags tell apart the
+// metrics of each delay.
+func NewDelay(percentile float64, max time.Duration, tags metrics.Tags) *Delay {
+	return &Delay{
+		percentile:   percentile,
+		max:          max,
+		current:      int64(max),
+		metricHedges: metrics.AddCounter("hedge_requests", tags),
+		metricWins:   metrics.AddCounter("hedge_wins", tags),
+		metricDelay:  metrics.AddIntGauge("hedge_delay_us", tags),
+		samples:      make([]time.Duration, samples),
+	}
+}
+
+// Get returns the delay after which requests are hedged.
+func (d *Delay) Get() time.Duration {
+	return time.Duration(atomic.LoadInt64(&d.current))
+}
+
+// Observe records the latency of an answered request.
+func (d *Delay) Observe(elapsed time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.samples[d.next] = elapsed
+	d.next = (d.next + 1) % len(d.samples)
+	d.count++
+	if d.count < len(d.samples) || d.count%refresh != 0 {
+		return
+	}
+
+	sorted := make([]time.Duration, len(d.samples))
+	copy(sorted, d.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	current := sorted[int(d.percentile*float64(len(sorted)-1))]
+	if current > d.max {
+		current = d.max
+	}
+	atomic.StoreInt64(&d.current, int64(current))
+	metrics.SetIntGauge(d.metricDelay, uint64(current/time.Microsecond))
+}
+
+// Race runs equivalent attempts, in order of preference, until one of them
+// answers by returning nil. The next attempt starts as soon as one fails,
+// or when none answered within the delay. Race returns the index of the
+// answering attempt, -1 when they all failed, and the errors of the
+// attempts that returned before. Slower attempts are left running and
+// must not touch anything but their own results. A nil Delay never hedges,
+// trying attempts one after the other.
+func (d *Delay) Race(attempts ...func() error) (int, []error) {
+	type result struct {
+		i   int
+		err error
+	}
+	results := make(chan result, len(attempts))
+	errs := make([]error, len(attempts))
+
+	started, pending := 0, 0
+	start := func() {
+		i := started
+		started++
+		pending++
+		go func() {
+			begin := time.Now()
+			err := attempts[i]()
+			if err == nil && d != nil {
+				d.Observe(time.Since(begin))
+			}
+			results <- result{i: i, err: err}
+		}()
+	}
+
+	var timer *time.Timer
+	var hedge <-chan time.Time
+	arm := func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		hedge = nil
+		if d != nil && started < len(attempts) {
+			timer = time.NewTimer(d.Get())
+			hedge = timer.C
+		}
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	hedged := false
+	start()
+	arm()
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			errs[res.i] = res.err
+			if res.err == nil {
+				if hedged && res.i > 0 {
+					metrics.IncCounter(d.metricWins)
+				}
+				return res.i, errs
+			}
+			if started < len(attempts) {
+				start()
+				arm()
+			}
+
+		case <-hedge:
+			metrics.IncCounter(d.metricHedges)
+			hedged = true
+			start()
+			arm()
+		}
+	}
+	return -1, errs
+}
@@ -0,0 +1,177 @@
+package hedge
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var errFailed = errors.New("failed")
+
+func newDelay(percentile float64, max time.Duration) *Delay {
+	return NewDelay(percentile, max, metrics.Tags{"test": "hedge"})
+}
+
+func TestDelayFollowsPercentileOfRecentLatencies(t *testing.T) {
+	d := newDelay(0.5, time.Second)
+	for i := 0; i < samples-1; i++ {
+		d.Observe(time.Millisecond)
+	}
+	if got := d.Get(); got != time.Second {
+		t.Errorf("got %v before enough latencies are known, want the max delay", got)
+	}
+
+	d.Observe(time.Millisecond)
+	if got := d.Get(); got != time.Millisecond {
+		t.Errorf("got %v, want the median of 1ms", got)
+	}
+
+	// The delay is only refreshed every refresh latencies
+	for i := 0; i < refresh-1; i++ {
+		d.Observe(10 * time.Millisecond)
+	}
+	if got := d.Get(); got != time.Millisecond {
+		t.Errorf("got %v before a refresh, want 1ms still", got)
+	}
+	for i := 0; i < samples; i++ {
+		d.Observe(10 * time.Millisecond)
+	}
+	if got := d.Get(); got != 10*time.Millisecond {
+		t.Errorf("got %v, want the median of 10ms", got)
+	}
+}
+
+func TestDelayCappedAtMax(t *testing.T) {
+	d := newDelay(0.95, 20*time.Millisecond)
+	for i := 0; i < samples; i++ {
+		d.Observe(time.Second)
+	}
+	if got := d.Get(); got != 20*time.Millisecond {
+		t.Errorf("got %v, want the max delay of 20ms", got)
+	}
+}
+
+func TestRaceHedgesAfterDelay(t *testing.T) {
+	d := newDelay(0.95, 10*time.Millisecond)
+	release := make(chan struct{})
+	defer close(release)
+
+	start := time.Now()
+	chosen, errs := d.Race(
+		func() error { <-release; return nil },
+		func() error { return nil },
+	)
+	if chosen != 1 {
+		t.Errorf("got attempt %d, want the hedge", chosen)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("hedged after %v, before the delay", elapsed)
+	}
+	if errs[0] != nil || errs[1] != nil {
+		t.Errorf("got errors %v, want none", errs)
+	}
+
+	// Attempts answering within the delay are not hedged
+	hedged := false
+	chosen, _ = d.Race(
+		func() error { return nil },
+		func() error { hedged = true; return nil },
+	)
+	if chosen != 0 || hedged {
+		t.Errorf("got attempt %d, hedged %v, want the first one alone", chosen, hedged)
+	}
+}
+
+func TestRaceLeavesLosersToFinish(t *testing.T) {
+	d := newDelay(0.95, time.Millisecond)
+	goroutines := runtime.NumGoroutine()
+
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	loser := 0
+	chosen, _ := d.Race(
+		func() error {
+			<-release
+			loser = 1
+			close(finished)
+			return nil
+		},
+		func() error { return nil },
+	)
+	if chosen != 1 {
+		t.Fatalf("got attempt %d, want the hedge", chosen)
+	}
+
+	// The loser returns without anyone reading its result
+	close(release)
+	<-finished
+	if loser != 1 {
+		t.Errorf("loser did not complete")
+	}
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > goroutines; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d goroutines after the race, want %d", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRaceAnswersWinOverErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		delay   *Delay
+		results []error
+		chosen  int
+		errs    []error
+	}{
+		{
+			name:    "first answers",
+			delay:   newDelay(0.95, time.Second),
+			results: []error{nil, errFailed},
+			chosen:  0,
+			errs:    []error{nil, nil},
+		},
+		{
+			name:    "failure starts the next one",
+			delay:   newDelay(0.95, time.Second),
+			results: []error{errFailed, nil},
+			chosen:  1,
+			errs:    []error{errFailed, nil},
+		},
+		{
+			name:    "all fail",
+			delay:   newDelay(0.95, time.Second),
+			results: []error{errFailed, errFailed},
+			chosen:  -1,
+			errs:    []error{errFailed, errFailed},
+		},
+		{
+			name:    "sequential without delay",
+			results: []error{errFailed, errFailed, nil},
+			chosen:  2,
+			errs:    []error{errFailed, errFailed, nil},
+		},
+	} {
+		attempts := make([]func() error, len(tt.results))
+		for i, err := range tt.results {
+			err := err
+			attempts[i] = func() error { return err }
+		}
+		start := time.Now()
+		chosen, errs := tt.delay.Race(attempts...)
+		if chosen != tt.chosen {
+			t.Errorf("%s: got attempt %d, want %d", tt.name, chosen, tt.chosen)
+		}
+		for i := range tt.errs {
+			if errs[i] != tt.errs[i] {
+				t.Errorf("%s: got error %v for attempt %d, want %v", tt.name, errs[i], i, tt.errs[i])
+			}
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("%s: waited %v for the delay, want failures to start the next attempt", tt.name, elapsed)
+		}
+	}
+}
@@ -0,0 +1,523 @@
+// Package orca provides the epoxy orchestrator. It owns the policies
+// applied to pools, replication, gutter fallback and shadowing, along with
+// routing keys among pools and coalescing gets, and puts a short lived in
+// process cache in front of them.
+package orca
+
+import (
+	"time"
+
+	"github.com/BarthV/epoxy/handlers/router"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/orcas"
+)
+
+// Config holds the settings of the epoxy orchestrator.
+type Config struct {
+	// L1TTL bounds how long the in process cache serves an item filled
+	// from pools. Writes through other proxies are not seen before.
+	L1TTL time.Duration
+	// Pools are the pools requests are routed to, by name, along with
+	// their replication and gutter fallback.
+	Pools map[string]Pool
+	// Routes send keys to pools, the ones no route matches going to the
+	// pool named Default.
+	Routes  []router.Route
+	Default string
+	// Coalesce shares one fetch among the gets of a key in flight at the
+	// same moment, across all connections.
+	Coalesce bool
+	// Shadow mirrors requests to another pool, none when nil.
+	Shadow *Shadow
+}
+
+// EpoxyOrca serves requests from the pools behind its L2, built by Config.L2
+// with the policies of every pool. When given an L1, an in process cache,
+// gets are served from it first and fill it from the pools, while writes to
+// the pools invalidate it. Unlike rend's L1L2 orcas, the L1 never fails a
+// request, items it holds expire quickly so that writes through other
+// proxies show up, and text gets asking for CAS uniques, which it has none
+// of, go to the pools. Binary gets, always asking for them, are answered
+// from it with a zero CAS unique.
+type EpoxyOrca struct {
+	conf Config
+	l1   handlers.Handler
+	l2   handlers.Handler
+	res  common.Responder
+}
+
+// Epoxy returns the constructor of epoxy orchestrators applying conf, whose
+// L2 must come from conf.L2. l1 may be nil.
+func Epoxy(conf Config) orcas.OrcaConst {
+	return func(l1, l2 handlers.Handler, res common.Responder) orcas.Orca {
+		return &EpoxyOrca{
+			conf: conf,
+			l1:   l1,
+			l2:   l2,
+			res:  res,
+		}
+	}
+}
+
+// since returns the nanoseconds elapsed since start, for histograms.
+func since(start time.Time) uint64 {
+	return uint64(time.Since(start))
+}
+
+// invalidate drops key from the L1 after a write to pools, whatever its
+// outcome since a failed write may still have been applied.
+func (e *EpoxyOrca) invalidate(key []byte) {
+	if e.l1 == nil {
+		return
+	}
+	metrics.IncCounter(orcas.MetricCmdDeleteL1)
+	if err := e.l1.Delete(common.DeleteRequest{Key: key}); err == nil {
+		metrics.IncCounter(orcas.MetricCmdDeleteHitsL1)
+	} else {
+		metrics.IncCounter(orcas.MetricCmdDeleteMissesL1)
+	}
+}
+
+func (e *EpoxyOrca) Set(req common.SetRequest) error {
+	metrics.IncCounter(orcas.MetricCmdSetL2)
+	start := time.Now()
+
+	err := e.l2.Set(req)
+
+	metrics.ObserveHist(orcas.HistSetL2, since(start))
+	e.invalidate(req.Key)
+
+	if err != nil {
+		metrics.IncCounter(orcas.MetricCmdSetErrorsL2)
+		metrics.IncCounter(orcas.MetricCmdSetErrors)
+		return err
+	}
+	metrics.IncCounter(orcas.MetricCmdSetSuccessL2)
+	metrics.IncCounter(orcas.MetricCmdSetSuccess)
+	return e.res.Set(req.Opaque, req.Quiet)
+}
+
+func (e *EpoxyOrca) Add(req common.SetRequest) error {
+	metrics.IncCounter(orcas.MetricCmdAddL2)
+	start := time.Now()
+
+	err := e.l2.Add(req)
+
+	metrics.ObserveHist(orcas.HistAddL2, since(start))
+	e.invalidate(req.Key)
+
+	if err == common.ErrKeyExists {
+		metrics.IncCounter(orcas.MetricCmdAddNotStoredL2)
+		metrics.IncCounter(orcas.MetricCmdAddNotStored)
+		return err
+	} else if err != nil {
+		metrics.IncCounter(orcas.MetricCmdAddErrorsL2)
+		metrics.IncCounter(orcas.MetricCmdAddErrors)
+		return err
+	}
+	metrics.IncCounter(orcas.MetricCmdAddStoredL2)
+	metrics.IncCounter(orcas.MetricCmdAddStored)
+	return e.res.Add(req.Opaque, req.Quiet)
+}
+
+func (e *EpoxyOrca) Replace(req common.SetRequest) error {
+	metrics.IncCounter(orcas.MetricCmdReplaceL2)
+	start := time.Now()
+
+	err := e.l2.Replace(req)
+
+	metrics.ObserveHist(orcas.HistReplaceL2, since(start))
+	e.invalidate(req.Key)
+
+	if err == common.ErrKeyNotFound {
+		metrics.IncCounter(orcas.MetricCmdReplaceNotStoredL2)
+		metrics.IncCounter(orcas.MetricCmdReplaceNotStored)
+		return err
+	} else if err != nil {
+		metrics.IncCounter(orcas.MetricCmdReplaceErrorsL2)
+		metrics.IncCounter(orcas.MetricCmdReplaceErrors)
+		return err
+	}
+	metrics.IncCounter(orcas.MetricCmdReplaceStoredL2)
+	metrics.IncCounter(orcas.MetricCmdReplaceStored)
+	return e.res.Replace(req.Opaque, req.Quiet)
+}
+
+func (e *EpoxyOrca) Append(req common.SetRequest) error {
+	metrics.IncCounter(orcas.MetricCmdAppendL2)
+	start := time.Now()
+
+	err := e.l2.Append(req)
+
+	metrics.ObserveHist(orcas.HistAppendL2, since(start))
+	e.invalidate(req.Key)
+
+	if err == common.ErrItemNotStored {
+		metrics.IncCounter(orcas.MetricCmdAppendNotStoredL2)
+		metrics.IncCounter(orcas.MetricCmdAppendNotStored)
+		return err
+	} else if err != nil {
+		metrics.IncCounter(orcas.MetricCmdAppendErrorsL2)
+		metrics.IncCounter(orcas.MetricCmdAppendErrors)
+		return err
+	}
+	metrics.IncCounter(orcas.MetricCmdAppendStoredL2)
+	metrics.IncCounter(orcas.MetricCmdAppendStored)
+	return e.res.Append(req.Opaque, req.Quiet)
+}
+
+func (e *EpoxyOrca) Prepend(req common.SetRequest) error {
+	metrics.IncCounter(orcas.MetricCmdPrependL2)
+	start := time.Now()
+
+	err := e.l2.Prepend(req)
+
+	metrics.ObserveHist(orcas.HistPrependL2, since(start))
+	e.invalidate(req.Key)
+
+	if err == common.ErrItemNotStored {
+		metrics.IncCounter(orcas.MetricCmdPrependNotStoredL2)
+		metrics.IncCounter(orcas.MetricCmdPrependNotStored)
+		return err
+	} else if err != nil {
+		metrics.IncCounter(orcas.MetricCmdPrependErrorsL2)
+		metrics.IncCounter(orcas.MetricCmdPrependErrors)
+		return err
+	}
+	metrics.IncCounter(orcas.MetricCmdPrependStoredL2)
+	metrics.IncCounter(orcas.MetricCmdPrependStored)
+	return e.res.Prepend(req.Opaque, req.Quiet)
+}
+
+func (e *EpoxyOrca) Delete(req common.DeleteRequest) error {
+	metrics.IncCounter(orcas.MetricCmdDeleteL2)
+	start := time.Now()
+
+	err := e.l2.Delete(req)
+
+	metrics.ObserveHist(orcas.HistDeleteL2, since(start))
+	e.invalidate(req.Key)
+
+	if err == common.ErrKeyNotFound {
+		metrics.IncCounter(orcas.MetricCmdDeleteMissesL2)
+		metrics.IncCounter(orcas.MetricCmdDeleteMisses)
+		return err
+	} else if err != nil {
+		metrics.IncCounter(orcas.MetricCmdDeleteErrorsL2)
+		metrics.IncCounter(orcas.MetricCmdDeleteErrors)
+		return err
+	}
+	metrics.IncCounter(orcas.MetricCmdDeleteHitsL2)
+	metrics.IncCounter(orcas.MetricCmdDeleteHits)
+	return e.res.Delete(req.Opaque)
+}
+
+func (e *EpoxyOrca) Touch(req common.TouchRequest) error {
+	metrics.IncCounter(orcas.MetricCmdTouchL2)
+	start := time.Now()
+
+	err := e.l2.Touch(req)
+
+	metrics.ObserveHist(orcas.HistTouchL2, since(start))
+	e.invalidate(req.Key)
+
+	if err == common.ErrKeyNotFound {
+		metrics.IncCounter(orcas.MetricCmdTouchMissesL2)
+		metrics.IncCounter(orcas.MetricCmdTouchMisses)
+		return err
+	} else if err != nil {
+		metrics.IncCounter(orcas.MetricCmdTouchErrorsL2)
+		metrics.IncCounter(orcas.MetricCmdTouchErrors)
+		return err
+	}
+	metrics.IncCounter(orcas.MetricCmdTouchHitsL2)
+	metrics.IncCounter(orcas.MetricCmdTouchHits)
+	return e.res.Touch(req.Opaque)
+}
+
+func (e *EpoxyOrca) Incr(req common.IncrDecrRequest) error {
+	metrics.IncCounter(orcas.MetricCmdIncrL2)
+	start := time.Now()
+
+	val, err := e.l2.Incr(req)
+
+	metrics.ObserveHist(orcas.HistIncrL2, since(start))
+	e.invalidate(req.Key)
+
+	if err == common.ErrKeyNotFound {
+		metrics.IncCounter(orcas.MetricCmdIncrMissesL2)
+		metrics.IncCounter(orcas.MetricCmdIncrMisses)
+		return err
+	} else if err != nil {
+		metrics.IncCounter(orcas.MetricCmdIncrErrorsL2)
+		metrics.IncCounter(orcas.MetricCmdIncrErrors)
+		return err
+	}
+	metrics.IncCounter(orcas.MetricCmdIncrHitsL2)
+	metrics.IncCounter(orcas.MetricCmdIncrHits)
+	return e.res.Incr(req.Opaque, val, req.Quiet)
+}
+
+func (e *EpoxyOrca) Decr(req common.IncrDecrRequest) error {
+	metrics.IncCounter(orcas.MetricCmdDecrL2)
+	start := time.Now()
+
+	val, err := e.l2.Decr(req)
+
+	metrics.ObserveHist(orcas.HistDecrL2, since(start))
+	e.invalidate(req.Key)
+
+	if err == common.ErrKeyNotFound {
+		metrics.IncCounter(orcas.MetricCmdDecrMissesL2)
+		metrics.IncCounter(orcas.MetricCmdDecrMisses)
+		return err
+	} else if err != nil {
+		metrics.IncCounter(orcas.MetricCmdDecrErrorsL2)
+		metrics.IncCounter(orcas.MetricCmdDecrErrors)
+		return err
+	}
+	metrics.IncCounter(orcas.MetricCmdDecrHitsL2)
+	metrics.IncCounter(orcas.MetricCmdDecrHits)
+	return e.res.Decr(req.Opaque, val, req.Quiet)
+}
+
+func (e *EpoxyOrca) Get(req common.GetRequest) error {
+	metrics.IncCounterBy(orcas.MetricCmdGetKeys, uint64(len(req.Keys)))
+
+	if e.l1 != nil && (!req.Cas || req.CasOptional) {
+		var err error
+		req, err = e.getL1(req)
+		if err != nil || len(req.Keys) == 0 {
+			if err != nil {
+				return err
+			}
+			return e.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+		}
+	}
+
+	metrics.IncCounter(orcas.MetricCmdGetL2)
+	metrics.IncCounterBy(orcas.MetricCmdGetKeysL2, uint64(len(req.Keys)))
+	start := time.Now()
+
+	resChan, errChan := e.l2.Get(req)
+
+	var err error
+	for {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else {
+				if res.Miss {
+					metrics.IncCounter(orcas.MetricCmdGetMissesL2)
+					metrics.IncCounter(orcas.MetricCmdGetMisses)
+				} else {
+					metrics.IncCounter(orcas.MetricCmdGetHitsL2)
+					metrics.IncCounter(orcas.MetricCmdGetHits)
+					e.fill(res)
+				}
+				e.res.Get(res)
+			}
+
+		case getErr, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				metrics.IncCounter(orcas.MetricCmdGetErrorsL2)
+				metrics.IncCounter(orcas.MetricCmdGetErrors)
+				err = getErr
+			}
+		}
+
+		if resChan == nil && errChan == nil {
+			break
+		}
+	}
+
+	metrics.ObserveHist(orcas.HistGetL2, since(start))
+
+	if err != nil {
+		return err
+	}
+	return e.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+}
+
+// getL1 answers the keys of req the L1 holds and returns the request for
+// the others.
+func (e *EpoxyOrca) getL1(req common.GetRequest) (common.GetRequest, error) {
+	metrics.IncCounter(orcas.MetricCmdGetL1)
+	metrics.IncCounterBy(orcas.MetricCmdGetKeysL1, uint64(len(req.Keys)))
+	start := time.Now()
+
+	resChan, errChan := e.l1.Get(req)
+
+	missed := common.GetRequest{
+		NoopOpaque:  req.NoopOpaque,
+		NoopEnd:     req.NoopEnd,
+		Cas:         req.Cas,
+		CasOptional: req.CasOptional,
+	}
+	var err error
+	for {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else if res.Miss {
+				metrics.IncCounter(orcas.MetricCmdGetMissesL1)
+				missed.Keys = append(missed.Keys, res.Key)
+				missed.Opaques = append(missed.Opaques, res.Opaque)
+				missed.Quiet = append(missed.Quiet, res.Quiet)
+			} else {
+				metrics.IncCounter(orcas.MetricCmdGetHitsL1)
+				metrics.IncCounter(orcas.MetricCmdGetHits)
+				e.res.Get(res)
+			}
+
+		case getErr, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				metrics.IncCounter(orcas.MetricCmdGetErrorsL1)
+				metrics.IncCounter(orcas.MetricCmdGetErrors)
+				err = getErr
+			}
+		}
+
+		if resChan == nil && errChan == nil {
+			break
+		}
+	}
+
+	metrics.ObserveHist(orcas.HistGetL1, since(start))
+	return missed, err
+}
+
+// fill stores an item read from pools in the L1, for a short while.
+func (e *EpoxyOrca) fill(res common.GetResponse) {
+	if e.l1 == nil {
+		return
+	}
+	exptime := uint32(e.conf.L1TTL / time.Second)
+	if exptime == 0 {
+		return
+	}
+
+	metrics.IncCounter(orcas.MetricCmdGetSetL1)
+	err := e.l1.Set(common.SetRequest{
+		Key:     res.Key,
+		Flags:   res.Flags,
+		Exptime: exptime,
+		Data:    res.Data,
+	})
+	if err != nil {
+		metrics.IncCounter(orcas.MetricCmdGetSetErrorsL1)
+		return
+	}
+	metrics.IncCounter(orcas.MetricCmdGetSetSucessL1)
+}
+
+// GetE goes to pools, which know the remaining TTLs.
+func (e *EpoxyOrca) GetE(req common.GetRequest) error {
+	metrics.IncCounterBy(orcas.MetricCmdGetEKeys, uint64(len(req.Keys)))
+	metrics.IncCounter(orcas.MetricCmdGetEL2)
+	metrics.IncCounterBy(orcas.MetricCmdGetEKeysL2, uint64(len(req.Keys)))
+	start := time.Now()
+
+	resChan, errChan := e.l2.GetE(req)
+
+	var err error
+	for {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else {
+				if res.Miss {
+					metrics.IncCounter(orcas.MetricCmdGetEMissesL2)
+					metrics.IncCounter(orcas.MetricCmdGetEMisses)
+				} else {
+					metrics.IncCounter(orcas.MetricCmdGetEHitsL2)
+					metrics.IncCounter(orcas.MetricCmdGetEHits)
+				}
+				e.res.GetE(res)
+			}
+
+		case getErr, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				metrics.IncCounter(orcas.MetricCmdGetEErrorsL2)
+				metrics.IncCounter(orcas.MetricCmdGetEErrors)
+				err = getErr
+			}
+		}
+
+		if resChan == nil && errChan == nil {
+			break
+		}
+	}
+
+	metrics.ObserveHist(orcas.HistGetEL2, since(start))
+
+	if err != nil {
+		return err
+	}
+	return e.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+}
+
+// Gat goes to pools and invalidates the L1, whose copy of the item has the
+// former TTL.
+func (e *EpoxyOrca) Gat(req common.GATRequest) error {
+	metrics.IncCounter(orcas.MetricCmdGatL2)
+	start := time.Now()
+
+	res, err := e.l2.GAT(req)
+
+	metrics.ObserveHist(orcas.HistGatL2, since(start))
+	e.invalidate(req.Key)
+
+	if err != nil {
+		metrics.IncCounter(orcas.MetricCmdGatErrorsL2)
+		metrics.IncCounter(orcas.MetricCmdGatErrors)
+		return err
+	}
+	if res.Miss {
+		metrics.IncCounter(orcas.MetricCmdGatMissesL2)
+		metrics.IncCounter(orcas.MetricCmdGatMisses)
+	} else {
+		metrics.IncCounter(orcas.MetricCmdGatHitsL2)
+		metrics.IncCounter(orcas.MetricCmdGatHits)
+	}
+	return e.res.GAT(res)
+}
+
+func (e *EpoxyOrca) Noop(req common.NoopRequest) error {
+	return e.res.Noop(req.Opaque)
+}
+
+func (e *EpoxyOrca) Quit(req common.QuitRequest) error {
+	return e.res.Quit(req.Opaque, req.Quiet)
+}
+
+func (e *EpoxyOrca) Version(req common.VersionRequest) error {
+	return e.res.Version(req.Opaque)
+}
+
+func (e *EpoxyOrca) Unknown(req common.Request) error {
+	return common.ErrUnknownCmd
+}
+
+func (e *EpoxyOrca) Error(req common.Request, reqType common.RequestType, err error) {
+	var opaque uint32
+	var quiet bool
+
+	if req != nil {
+		opaque = req.GetOpaque()
+		quiet = req.IsQuiet()
+	}
+
+	e.res.Error(opaque, reqType, err, quiet)
+}
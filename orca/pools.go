@@ -0,0 +1,125 @@
+package orca
+
+import (
+	"time"
+
+	"github.com/BarthV/epoxy/handlers/coalesce"
+	"github.com/BarthV/epoxy/handlers/gutter"
+	"github.com/BarthV/epoxy/handlers/multiget"
+	"github.com/BarthV/epoxy/handlers/replicated"
+	"github.com/BarthV/epoxy/handlers/router"
+	"github.com/BarthV/epoxy/handlers/shadow"
+	"github.com/BarthV/epoxy/hedge"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+// Pool is a pool of memcached servers, along with the policies the epoxy
+// orchestrator applies to it.
+type Pool struct {
+	// Replica returns the constructor of the handlers talking to the i-th
+	// replica of every key, reporting backend failures as mode tells.
+	Replica func(i int, mode multiget.Mode) handlers.HandlerConst
+	// Replicas is the number of servers storing each key. Writes go to
+	// every one of them, reads to the first healthy one.
+	Replicas int
+	// Mode tells how keys failing on backend errors are answered.
+	Mode multiget.Mode
+	// Gutter names the pool serving the keys of failed servers, none when
+	// empty. Items written to it expire after GutterTTL at most.
+	Gutter    string
+	GutterTTL time.Duration
+	// Hedge returns the hedging delay of reads sent to the next replica or
+	// to the gutter pool, named by target. Reads are not hedged when it is
+	// nil or returns nil.
+	Hedge func(target string) *hedge.Delay
+}
+
+// Shadow mirrors a sampled fraction of the requests to the pool named Pool,
+// comparing its answers to gets with the primary ones.
+type Shadow struct {
+	Pool string
+	Rate float64
+	Mode shadow.Mode
+}
+
+// Policies tells whether conf replicates keys, falls back to gutter pools
+// or shadows requests, which only the epoxy orchestrator does.
+func (c Config) Policies() bool {
+	if c.Shadow != nil {
+		return true
+	}
+	for _, p := range c.Pools {
+		if p.Replicas > 1 || p.Gutter != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// L2 returns the constructor of the handlers the epoxy orchestrator reads
+// and writes through: requests are routed to pools by key, each pool
+// applying its replication and gutter fallback, then shared among
+// connections when coalescing, and mirrored to the shadow pool.
+func (c Config) L2() handlers.HandlerConst {
+	started := make(map[string]handlers.HandlerConst, len(c.Pools))
+	for name, p := range c.Pools {
+		mode := p.Mode
+		switch {
+		case p.Gutter != "":
+			// Failures must reach the gutter handler, key by key
+			mode = multiget.FailKeys
+		case c.Shadow != nil && name == c.Shadow.Pool:
+			// Failures must not be taken for mismatching misses
+			mode = multiget.FailClosed
+		}
+		started[name] = p.start(mode)
+	}
+
+	pools := make(map[string]handlers.HandlerConst, len(c.Pools))
+	for name, p := range c.Pools {
+		pools[name] = started[name]
+		if p.Gutter != "" {
+			pools[name] = gutter.New(
+				started[name],
+				started[p.Gutter],
+				p.GutterTTL,
+				p.Mode,
+				p.hedge("gutter"),
+				metrics.Tags{"pool": name},
+			)
+		}
+	}
+
+	l2 := router.New(pools, c.Routes, c.Default)
+	if c.Coalesce {
+		l2 = coalesce.New(l2)
+	}
+	if c.Shadow != nil {
+		l2 = shadow.New(l2, started[c.Shadow.Pool], c.Shadow.Rate, c.Shadow.Mode)
+	}
+	return l2
+}
+
+// start returns the constructor of the handlers of p, answering keys that
+// fail on backend errors according to mode.
+func (p Pool) start(mode multiget.Mode) handlers.HandlerConst {
+	if p.Replicas <= 1 {
+		return p.Replica(0, mode)
+	}
+
+	// Replicas report failures key by key so that reads of the keys of a
+	// failed server fail over to the next replica
+	replicas := make([]handlers.HandlerConst, p.Replicas)
+	for i := range replicas {
+		replicas[i] = p.Replica(i, multiget.FailKeys)
+	}
+	return replicated.New(replicas, mode, p.hedge("replica"))
+}
+
+func (p Pool) hedge(target string) *hedge.Delay {
+	if p.Hedge == nil {
+		return nil
+	}
+	return p.Hedge(target)
+}
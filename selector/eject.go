@@ -0,0 +1,225 @@
+package selector
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/netflix/rend/metrics"
+)
+
+// probeTimeout bounds the whole probe of an ejected server.
+const probeTimeout = time.Second
+
+// Ejector is a selector leaving out of the wrapped one the servers that
+// failed too many times in a row, so that their keys move to healthy
+// servers instead of waiting for timeouts. Ejected servers are probed after
+// a cool-down and put back as soon as they answer again.
+type Ejector struct {
+	Selector
+
+	maxFailures int
+	coolDown    time.Duration
+	maxEjected  float64
+
+	metricEjections    uint32
+	metricRestorations uint32
+	metricEjected      uint32
+
+	mu       sync.Mutex
+	members  []*backend
+	backends map[string]*backend
+}
+
+// backend is the health of a server, known by its resolved address.
+type backend struct {
+	server   Server
+	addr     net.Addr
+	failures int
+	ejected  bool
+}
+
+// NewEjector returns a selector ejecting from s the servers failing
+// maxFailures times in a row for coolDown, as long as no more than the
+// maxEjected fraction of servers, rounded up, is out. The last server of a
+// pool is never ejected. tags tell apart the metrics of each ejector.
+func NewEjector(s Selector, maxFailures int, coolDown time.Duration, maxEjected float64, tags metrics.Tags) *Ejector {
+	return &Ejector{
+		Selector:           s,
+		maxFailures:        maxFailures,
+		coolDown:           coolDown,
+		maxEjected:         maxEjected,
+		metricEjections:    metrics.AddCounter("selector_ejections", tags),
+		metricRestorations: metrics.AddCounter("selector_restorations", tags),
+		metricEjected:      metrics.AddIntGauge("selector_ejected", tags),
+		backends:           map[string]*backend{},
+	}
+}
+
+// SetServers changes the membership of the cluster. Servers still members
+// keep their health.
+func (e *Ejector) SetServers(servers ...Server) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	members := make([]*backend, len(servers))
+	backends := make(map[string]*backend, len(servers))
+	for i, server := range servers {
+		addr, err := resolve(server.Address)
+		if err != nil {
+			return err
+		}
+		b := &backend{server: server, addr: addr}
+		if old, ok := e.backends[addr.String()]; ok {
+			b.failures = old.failures
+			b.ejected = old.ejected
+		}
+		members[i] = b
+		backends[addr.String()] = b
+	}
+
+	e.members = members
+	e.backends = backends
+	return e.apply()
+}
+
+// ejected counts the ejected servers. e.mu must be held.
+func (e *Ejector) ejected() int {
+	ejected := 0
+	for _, b := range e.members {
+		if b.ejected {
+			ejected++
+		}
+	}
+	return ejected
+}
+
+// allowed returns how many servers may be ejected at once. e.mu must be
+// held.
+func (e *Ejector) allowed() int {
+	// Rounding up lets small pools eject a server too, the epsilon keeps
+	// exact products such as 0.3*10 from rounding up to the next server
+	allowed := int(math.Ceil(e.maxEjected*float64(len(e.members)) - 1e-9))
+	if allowed > len(e.members)-1 {
+		allowed = len(e.members) - 1
+	}
+	return allowed
+}
+
+// apply hands the servers not ejected to the wrapped selector. e.mu must
+// be held.
+func (e *Ejector) apply() error {
+	servers := make([]Server, 0, len(e.members))
+	for _, b := range e.members {
+		if !b.ejected {
+			servers = append(servers, b.server)
+		}
+	}
+	metrics.SetIntGauge(e.metricEjected, uint64(len(e.members)-len(servers)))
+	return e.Selector.SetServers(servers...)
+}
+
+// Observe records the outcome of an exchange with the server at addr. It
+// is meant to be the Observer of the memcache.Client using e.
+func (e *Ejector) Observe(addr net.Addr, elapsed time.Duration, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	b, ok := e.backends[addr.String()]
+	if !ok || b.ejected {
+		return
+	}
+	if err == nil {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures < e.maxFailures {
+		return
+	}
+
+	ejected := e.ejected()
+	if ejected >= e.allowed() {
+		log.WithError(err).WithFields(log.Fields{
+			"server":  b.server.Address,
+			"ejected": ejected,
+		}).Error("Failing server kept, too many servers ejected already")
+		return
+	}
+
+	b.ejected = true
+	if err := e.apply(); err != nil {
+		log.WithError(err).Error("Memcached client serverlist update failed")
+	}
+	metrics.IncCounter(e.metricEjections)
+	log.WithError(err).WithFields(log.Fields{
+		"server":    b.server.Address,
+		"failures":  b.failures,
+		"cool-down": e.coolDown,
+	}).Warn("Server ejected")
+	go e.recover(b.addr)
+}
+
+// recover probes the ejected server at addr after each cool-down, until it
+// answers again or leaves the cluster.
+func (e *Ejector) recover(addr net.Addr) {
+	for {
+		time.Sleep(e.coolDown)
+
+		err := probe(addr)
+		e.mu.Lock()
+		b, ok := e.backends[addr.String()]
+		if !ok || !b.ejected {
+			e.mu.Unlock()
+			return
+		}
+		if err != nil {
+			e.mu.Unlock()
+			log.WithError(err).WithField("server", b.server.Address).Debug("Ejected server probe failed")
+			continue
+		}
+
+		b.ejected = false
+		b.failures = 0
+		if err := e.apply(); err != nil {
+			log.WithError(err).Error("Memcached client serverlist update failed")
+		}
+		e.mu.Unlock()
+
+		metrics.IncCounter(e.metricRestorations)
+		log.WithField("server", b.server.Address).Info("Server restored")
+		return
+	}
+}
+
+// probe asks the server at addr for its version.
+func probe(addr net.Addr) error {
+	nc, err := net.DialTimeout(addr.Network(), addr.String(), probeTimeout)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	if err := nc.SetDeadline(time.Now().Add(probeTimeout)); err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(nc, "version\r\n"); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(nc).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "VERSION ") {
+		return memcache.ErrServerError
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package selector
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+var errFailed = errors.New("failed")
+
+// pool returns n servers on distinct local ports nothing listens on.
+func pool(n int) []Server {
+	servers := make([]Server, n)
+	for i := range servers {
+		servers[i] = Server{Address: fmt.Sprintf("127.0.0.1:%d", 1+i)}
+	}
+	return servers
+}
+
+// live counts the servers the ejector hands to its selector.
+func live(t *testing.T, e *Ejector) int {
+	n := 0
+	if err := e.Each(func(net.Addr) error { n++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// fail reports failures in a row of server i.
+func fail(t *testing.T, e *Ejector, i, failures int) {
+	addr, err := resolve(e.members[i].server.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j := 0; j < failures; j++ {
+		e.Observe(addr, 0, errFailed)
+	}
+}
+
+func TestEjectorEjectsOnceLimitAllows(t *testing.T) {
+	hash, _ := ParseHash("crc32a")
+	e := NewEjector(NewModula(hash), 3, time.Hour, 0.5, nil)
+	if err := e.SetServers(pool(4)...); err != nil {
+		t.Fatal(err)
+	}
+
+	fail(t, e, 0, 3)
+	fail(t, e, 1, 3)
+	if got := live(t, e); got != 2 {
+		t.Fatalf("got %d live servers, want 2", got)
+	}
+
+	// Server 2 is kept at the limit, and ejected on its next failure once
+	// the limit allows it
+	fail(t, e, 2, 3)
+	if got := live(t, e); got != 2 {
+		t.Fatalf("got %d live servers, want 2", got)
+	}
+	if err := e.SetServers(append(pool(4), Server{Address: "127.0.0.1:5"}, Server{Address: "127.0.0.1:6"})...); err != nil {
+		t.Fatal(err)
+	}
+	fail(t, e, 2, 1)
+	if got := live(t, e); got != 3 {
+		t.Fatalf("got %d live servers, want 3", got)
+	}
+}
+
+func TestEjectorAllowed(t *testing.T) {
+	tests := []struct {
+		servers    int
+		maxEjected float64
+		want       int
+	}{
+		{1, 0.3, 0},
+		{2, 0.3, 1},
+		{3, 0.3, 1},
+		{4, 0.3, 2},
+		{10, 0.3, 3},
+		{10, 0, 0},
+		{4, 1, 3},
+	}
+	for _, test := range tests {
+		e := NewEjector(nil, 1, time.Hour, test.maxEjected, nil)
+		e.members = make([]*backend, test.servers)
+		if got := e.allowed(); got != test.want {
+			t.Errorf("%d servers, max %v: got %d, want %d", test.servers, test.maxEjected, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package selector
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// Hash maps a key to its position among servers. The functions below
+// reproduce the twemproxy ones bit for bit, quirks included: fnv 64 bits
+// variants are computed on 32 bits and key bytes are sign extended, as a
+// C char is, so that a key lands on the same server through twemproxy,
+// libmemcached and epoxy.
+type Hash func(key string) uint32
+
+var hashes = map[string]Hash{
+	"md5":      hashMD5,
+	"crc32":    hashCRC32,
+	"crc32a":   hashCRC32a,
+	"fnv1_32":  hashFNV132,
+	"fnv1a_32": hashFNV1a32,
+	"fnv1_64":  hashFNV164,
+	"fnv1a_64": hashFNV1a64,
+	"murmur":   hashMurmur,
+}
+
+// ParseHash returns the hash function known as name by twemproxy.
+func ParseHash(name string) (Hash, error) {
+	hash, ok := hashes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash function %q", name)
+	}
+	return hash, nil
+}
+
+const (
+	fnv32Init  = uint32(2166136261)
+	fnv32Prime = uint32(16777619)
+	fnv64Init  = uint64(0xcbf29ce484222325)
+	fnv64Prime = uint64(0x100000001b3)
+)
+
+// char is the value of a C char holding b, sign extended.
+func char(b byte) uint64 {
+	return uint64(int64(int8(b)))
+}
+
+func hashMD5(key string) uint32 {
+	return ketamaHash(md5.Sum([]byte(key)), 0)
+}
+
+// hashCRC32 is the libmemcached flavour of crc32, keeping 15 bits.
+func hashCRC32(key string) uint32 {
+	return (crc32.ChecksumIEEE([]byte(key)) >> 16) & 0x7fff
+}
+
+func hashCRC32a(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
+
+func hashFNV132(key string) uint32 {
+	hash := fnv32Init
+	for i := 0; i < len(key); i++ {
+		hash *= fnv32Prime
+		hash ^= uint32(char(key[i]))
+	}
+	return hash
+}
+
+func hashFNV1a32(key string) uint32 {
+	hash := fnv32Init
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(char(key[i]))
+		hash *= fnv32Prime
+	}
+	return hash
+}
+
+func hashFNV164(key string) uint32 {
+	hash := fnv64Init
+	for i := 0; i < len(key); i++ {
+		hash *= fnv64Prime
+		hash ^= char(key[i])
+	}
+	return uint32(hash)
+}
+
+func hashFNV1a64(key string) uint32 {
+	hash := uint32(fnv64Init & 0xffffffff)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(char(key[i]))
+		hash *= uint32(fnv64Prime & 0xffffffff)
+	}
+	return hash
+}
+
+// hashMurmur is MurmurHash2 seeded with the key length.
+func hashMurmur(key string) uint32 {
+	const (
+		m = uint32(0x5bd1e995)
+		r = 24
+	)
+	length := uint32(len(key))
+	h := (0xdeadbeef * length) ^ length
+
+	data := []byte(key)
+	for len(data) >= 4 {
+		k := binary.LittleEndian.Uint32(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+
+		h *= m
+		h ^= k
+		data = data[4:]
+	}
+
+	switch len(data) {
+	case 3:
+		h ^= uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
@@ -0,0 +1,42 @@
+package selector
+
+import "testing"
+
+// hashKeys are hashed by every function. Vectors were computed apart from
+// this package, following the C implementations of twemproxy. The last
+// keys check that bytes past 0x7f are sign extended as a C char is.
+var hashKeys = []string{"", "a", "foo", "123456789", "user:1234", "caf\xc3\xa9", "\xff\x80key"}
+
+func TestHashVectors(t *testing.T) {
+	tests := map[string][]uint32{
+		"md5":      {0xd98c1dd4, 0xb975c10c, 0xdb18bdac, 0x94e7f925, 0xe7f65f01, 0xe47f1107, 0x6c6760d1},
+		"crc32":    {0x00000000, 0x000068b7, 0x00000c73, 0x00004bf4, 0x000030b0, 0x000018ad, 0x000014ce},
+		"crc32a":   {0x00000000, 0xe8b7be43, 0x8c736521, 0xcbf43926, 0xb0b05457, 0x98ad42b5, 0x94cef411},
+		"fnv1_32":  {0x811c9dc5, 0x050c5d7e, 0x408f5e13, 0x24148816, 0x13b52562, 0xd682f171, 0xecbd69a5},
+		"fnv1a_32": {0x811c9dc5, 0xe40c292c, 0xa9f37ed7, 0xbb86b11c, 0x8457ce84, 0x7572c049, 0x74b62841},
+		"fnv1_64":  {0x84222325, 0x8601b7be, 0x6ba13533, 0x2bf916d6, 0xd3a43b42, 0x8a06fef1, 0xb5dcda05},
+		"fnv1a_64": {0x84222325, 0x8601ec8c, 0xfed9d577, 0x23c6cdfc, 0xa44673c4, 0xcef6bb89, 0x9b091321},
+		"murmur":   {0x00000000, 0x4b41757c, 0xc4e0338f, 0xb7760690, 0x3619c7c6, 0xda11981f, 0x84cd7bcd},
+	}
+	if len(tests) != len(hashes) {
+		t.Errorf("got vectors for %d hashes, want %d", len(tests), len(hashes))
+	}
+
+	for name, want := range tests {
+		hash, err := ParseHash(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, key := range hashKeys {
+			if got := hash(key); got != want[i] {
+				t.Errorf("%s(%q): got %#08x, want %#08x", name, key, got, want[i])
+			}
+		}
+	}
+}
+
+func TestParseHashUnknown(t *testing.T) {
+	if _, err := ParseHash("sha1"); err == nil {
+		t.Error("got no error for an unknown hash")
+	}
+}
@@ -0,0 +1,178 @@
+package selector
+
+import (
+	"crypto/md5"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	// ketamaPointsPerServer virtual nodes are placed on the ring for each
+	// server, ketamaPointsPerHash of them out of each md5 digest.
+	ketamaPointsPerServer = 160
+	ketamaPointsPerHash   = 4
+
+	// ketamaDefaultPort is left out of server names on the ring, as
+	// libmemcached does.
+	ketamaDefaultPort = "11211"
+)
+
+// Ketama is a consistent hashing selector, compatible with the libmemcached
+// ketama distribution. Each server owns many virtual nodes spread on a hash
+// ring and a key belongs to the first virtual node following its hash. When
+// a server joins or leaves, only the keys it owns, or is about to own, move.
+// Virtual nodes are always placed with md5, keys with the selector's hash.
+type Ketama struct {
+	hash Hash
+
+	mu     sync.RWMutex
+	addrs  []net.Addr
+	points []ketamaPoint
+}
+
+// NewKetama returns an empty ketama ring hashing keys with hash.
+func NewKetama(hash Hash) *Ketama {
+	return &Ketama{hash: hash}
+}
+
+type ketamaPoint struct {
+	hash   uint32
+	server int
+}
+
+type byHash []ketamaPoint
+
+func (p byHash) Len() int           { return len(p) }
+func (p byHash) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byHash) Less(i, j int) bool { return p[i].hash < p[j].hash }
+
+// SetServers changes the servers of the ring at runtime and is safe for
+// concurrent use by multiple goroutines. If any server fails to resolve, no
+// changes are made.
+func (k *Ketama) SetServers(servers ...Server) error {
+	totalWeight := 0
+	for _, server := range servers {
+		totalWeight += server.weight()
+	}
+
+	addrs := make([]net.Addr, len(servers))
+	points := make([]ketamaPoint, 0, len(servers)*ketamaPointsPerServer)
+	for i, server := range servers {
+		addr, err := resolve(server.Address)
+		if err != nil {
+			return err
+		}
+		addrs[i] = addr
+
+		name := ketamaName(server.Address)
+		digests := ketamaHashes(server.weight(), totalWeight, len(servers))
+		for h := 0; h < digests; h++ {
+			digest := md5.Sum([]byte(name + "-" + strconv.Itoa(h)))
+			for a := 0; a < ketamaPointsPerHash; a++ {
+				points = append(points, ketamaPoint{
+					hash:   ketamaHash(digest, a),
+					server: i,
+				})
+			}
+		}
+	}
+	sort.Sort(byHash(points))
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.addrs = addrs
+	k.points = points
+	return nil
+}
+
+// Each iterates over each server calling the given function
+func (k *Ketama) Each(f func(net.Addr) error) error {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, a := range k.addrs {
+		if err := f(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *Ketama) PickServer(key string) (net.Addr, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.addrs) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+	if len(k.addrs) == 1 {
+		return k.addrs[0], nil
+	}
+
+	hash := k.hash(key)
+	i := sort.Search(len(k.points), func(i int) bool {
+		return k.points[i].hash >= hash
+	})
+	if i == len(k.points) {
+		i = 0
+	}
+	return k.addrs[k.points[i].server], nil
+}
+
+// PickServers returns the n distinct servers following the hash of key on
+// the ring, the first one being the one PickServer returns. Fewer are
+// returned when the ring holds fewer servers.
+func (k *Ketama) PickServers(key string, n int) ([]net.Addr, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.addrs) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+	if n > len(k.addrs) {
+		n = len(k.addrs)
+	}
+
+	hash := k.hash(key)
+	start := sort.Search(len(k.points), func(i int) bool {
+		return k.points[i].hash >= hash
+	})
+	picked := make([]net.Addr, 0, n)
+	seen := make(map[int]bool, n)
+	for i := 0; i < len(k.points) && len(picked) < n; i++ {
+		server := k.points[(start+i)%len(k.points)].server
+		if !seen[server] {
+			seen[server] = true
+			picked = append(picked, k.addrs[server])
+		}
+	}
+	return picked, nil
+}
+
+// ketamaHashes returns how many md5 digests place the virtual nodes of a
+// server, in proportion to its weight. It reproduces the float32 rounding
+// of twemproxy, so that weighted rings match too.
+func ketamaHashes(weight, totalWeight, servers int) int {
+	pct := float32(weight) / float32(totalWeight)
+	points := float64(pct*ketamaPointsPerServer/ketamaPointsPerHash*float32(servers)) + 0.0000000001
+	return int(math.Floor(float64(float32(points))))
+}
+
+// ketamaName is the name a server is known by on the ring.
+func ketamaName(server string) string {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil || port != ketamaDefaultPort {
+		return server
+	}
+	return host
+}
+
+// ketamaHash reads the alignment-th little endian 32 bits word of digest.
+func ketamaHash(digest [md5.Size]byte, alignment int) uint32 {
+	return uint32(digest[3+alignment*4])<<24 |
+		uint32(digest[2+alignment*4])<<16 |
+		uint32(digest[1+alignment*4])<<8 |
+		uint32(digest[alignment*4])
+}
@@ -0,0 +1,62 @@
+package selector
+
+import (
+	"fmt"
+	"testing"
+)
+
+// placements returns the server s picks for each of the keys key:0 to
+// key:n-1.
+func placements(t *testing.T, s Selector, n int) []string {
+	servers := make([]string, n)
+	for i := range servers {
+		addr, err := s.PickServer(fmt.Sprintf("key:%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[i] = addr.String()
+	}
+	return servers
+}
+
+// Placement vectors were computed apart from this package, following the
+// ketama and modula algorithms of twemproxy and libmemcached. The third
+// server is on another port than the default one, so that it is named with
+// its port on the ring.
+func TestKetamaPlacement(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers []Server
+		want    []string
+	}{
+		{
+			"unweighted",
+			[]Server{{Address: "10.0.0.1:11211"}, {Address: "10.0.0.2:11211"}, {Address: "10.0.0.3:11212"}},
+			[]string{
+				"10.0.0.2:11211", "10.0.0.2:11211", "10.0.0.3:11212", "10.0.0.3:11212",
+				"10.0.0.2:11211", "10.0.0.3:11212", "10.0.0.3:11212", "10.0.0.3:11212",
+			},
+		},
+		{
+			"weighted",
+			[]Server{{Address: "10.0.0.1:11211", Weight: 1}, {Address: "10.0.0.2:11211", Weight: 3}, {Address: "10.0.0.3:11212", Weight: 2}},
+			[]string{
+				"10.0.0.2:11211", "10.0.0.2:11211", "10.0.0.2:11211", "10.0.0.3:11212",
+				"10.0.0.2:11211", "10.0.0.3:11212", "10.0.0.2:11211", "10.0.0.3:11212",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		k := NewKetama(hashMD5)
+		if err := k.SetServers(test.servers...); err != nil {
+			t.Fatal(err)
+		}
+		got := placements(t, k, len(test.want))
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: key:%d: got %s, want %s", test.name, i, got[i], test.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package selector
+
+import (
+	"net"
+	"sync"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Modula is a selector placing a key on the server at its hash modulo the
+// number of servers, as twemproxy's modula distribution does. A server of
+// weight N counts as N servers. With crc32a and unit weights, it places
+// keys as memcache.ServerList does.
+type Modula struct {
+	hash Hash
+
+	mu    sync.RWMutex
+	addrs []net.Addr
+	slots []net.Addr
+}
+
+// NewModula returns an empty modula selector hashing keys with hash.
+func NewModula(hash Hash) *Modula {
+	return &Modula{hash: hash}
+}
+
+// SetServers changes the servers at runtime and is safe for concurrent use
+// by multiple goroutines. If any server fails to resolve, no changes are
+// made.
+func (m *Modula) SetServers(servers ...Server) error {
+	addrs := make([]net.Addr, len(servers))
+	slots := make([]net.Addr, 0, len(servers))
+	for i, server := range servers {
+		addr, err := resolve(server.Address)
+		if err != nil {
+			return err
+		}
+		addrs[i] = addr
+		for w := 0; w < server.weight(); w++ {
+			slots = append(slots, addr)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addrs = addrs
+	m.slots = slots
+	return nil
+}
+
+// Each iterates over each server calling the given function
+func (m *Modula) Each(f func(net.Addr) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, a := range m.addrs {
+		if err := f(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Modula) PickServer(key string) (net.Addr, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.addrs) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+	return m.slots[m.hash(key)%uint32(len(m.slots))], nil
+}
+
+// PickServers returns the n distinct servers of the slots following the
+// hash of key, the first one being the one PickServer returns. Fewer are
+// returned when there are fewer servers.
+func (m *Modula) PickServers(key string, n int) ([]net.Addr, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.addrs) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+	if n > len(m.addrs) {
+		n = len(m.addrs)
+	}
+
+	start := int(m.hash(key) % uint32(len(m.slots)))
+	picked := make([]net.Addr, 0, n)
+	seen := make(map[net.Addr]bool, n)
+	for i := 0; i < len(m.slots) && len(picked) < n; i++ {
+		addr := m.slots[(start+i)%len(m.slots)]
+		if !seen[addr] {
+			seen[addr] = true
+			picked = append(picked, addr)
+		}
+	}
+	return picked, nil
+}
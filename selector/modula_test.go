@@ -0,0 +1,41 @@
+package selector
+
+import "testing"
+
+func TestModulaPlacement(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers []Server
+		want    []string
+	}{
+		{
+			"unweighted",
+			[]Server{{Address: "10.0.0.1:11211"}, {Address: "10.0.0.2:11211"}, {Address: "10.0.0.3:11212"}},
+			[]string{
+				"10.0.0.2:11211", "10.0.0.1:11211", "10.0.0.3:11212", "10.0.0.3:11212",
+				"10.0.0.3:11212", "10.0.0.2:11211", "10.0.0.3:11212", "10.0.0.2:11211",
+			},
+		},
+		{
+			"weighted",
+			[]Server{{Address: "10.0.0.1:11211", Weight: 1}, {Address: "10.0.0.2:11211", Weight: 3}, {Address: "10.0.0.3:11212", Weight: 2}},
+			[]string{
+				"10.0.0.3:11212", "10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.2:11211",
+				"10.0.0.3:11212", "10.0.0.2:11211", "10.0.0.3:11212", "10.0.0.2:11211",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		m := NewModula(hashCRC32a)
+		if err := m.SetServers(test.servers...); err != nil {
+			t.Fatal(err)
+		}
+		got := placements(t, m, len(test.want))
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: key:%d: got %s, want %s", test.name, i, got[i], test.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package selector
+
+import (
+	"net"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// replica is the view of a selector picking the replica-th server of each
+// key.
+type replica struct {
+	Selector
+	replica int
+}
+
+// Replica returns a selector picking, for each key, the replica-th of the
+// servers s picks for it, counting from 0. A memcache.Client built on it
+// talks to that replica of every key. When the cluster holds fewer servers
+// than replicas, replicas wrap around onto the first servers.
+func Replica(s Selector, n int) memcache.ServerSelector {
+	return &replica{Selector: s, replica: n}
+}
+
+func (r *replica) PickServer(key string) (net.Addr, error) {
+	servers, err := r.PickServers(key, r.replica+1)
+	if err != nil {
+		return nil, err
+	}
+	return servers[r.replica%len(servers)], nil
+}
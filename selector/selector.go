@@ -0,0 +1,61 @@
+// Package selector provides the memcache.ServerSelector implementations
+// placing keys on the servers of a cluster.
+package selector
+
+import (
+	"net"
+	"strings"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Server is a memcached server known to a selector.
+type Server struct {
+	// Address is a host:port or a unix socket path.
+	Address string
+	// Weight is the share of the keyspace the server owns relative to
+	// other servers. Anything below 1 counts as 1.
+	Weight int
+}
+
+// Selector is a memcache.ServerSelector whose servers can be changed at
+// runtime.
+type Selector interface {
+	memcache.ServerSelector
+	SetServers(servers ...Server) error
+	// PickServers returns up to n distinct servers for key, in order of
+	// preference.
+	PickServers(key string, n int) ([]net.Addr, error)
+}
+
+func (s Server) weight() int {
+	if s.Weight < 1 {
+		return 1
+	}
+	return s.Weight
+}
+
+// staticAddr caches the Network() and String() values from any net.Addr.
+type staticAddr struct {
+	ntw, str string
+}
+
+func (s *staticAddr) Network() string { return s.ntw }
+func (s *staticAddr) String() string  { return s.str }
+
+// resolve turns a server, either a host:port or a unix socket path, into
+// its address, the way memcache.ServerList does.
+func resolve(server string) (net.Addr, error) {
+	if strings.Contains(server, "/") {
+		addr, err := net.ResolveUnixAddr("unix", server)
+		if err != nil {
+			return nil, err
+		}
+		return &staticAddr{ntw: addr.Network(), str: addr.String()}, nil
+	}
+	addr, err := net.ResolveTCPAddr("tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	return &staticAddr{ntw: addr.Network(), str: addr.String()}, nil
+}